@@ -0,0 +1,457 @@
+// Package anthropic answers chat completion requests with Anthropic's Messages API. The requests and the responses
+// are in the format of the openai package, so the bot can use either provider.
+package anthropic
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"github.com/mimrock/rocketchat_openai_bot/retry"
+)
+
+// DefaultMaxTokens is sent when the request does not limit the length of the answer, because the Messages API
+// requires a limit.
+const DefaultMaxTokens = 1024
+
+type Anthropic struct {
+	HostName       string
+	ApiKey         string
+	Version        string // The value of the anthropic-version header.
+	MaxRetries     int
+	RetryDelay     time.Duration
+	RequestTimeout time.Duration
+}
+
+func NewFromConfig(config *config.Config) *Anthropic {
+	return &Anthropic{
+		HostName:       config.Anthropic.HostName,
+		ApiKey:         config.Anthropic.ApiKey,
+		Version:        config.Anthropic.Version,
+		MaxRetries:     config.OpenAI.MaxRetries,
+		RetryDelay:     config.OpenAI.RetryDelay,
+		RequestTimeout: config.OpenAI.RequestTimeout,
+	}
+}
+
+type request struct {
+	Model       string      `json:"model"`
+	System      string      `json:"system,omitempty"`
+	Messages    []message   `json:"messages"`
+	MaxTokens   int         `json:"max_tokens"`
+	Temperature *float64    `json:"temperature,omitempty"`
+	TopP        *float64    `json:"top_p,omitempty"`
+	Tools       []tool      `json:"tools,omitempty"`
+	ToolChoice  *toolChoice `json:"tool_choice,omitempty"`
+	Stream      bool        `json:"stream,omitempty"`
+	Metadata    *metadata   `json:"metadata,omitempty"`
+}
+
+type metadata struct {
+	UserId string `json:"user_id"`
+}
+
+type message struct {
+	Role    string         `json:"role"`
+	Content []contentBlock `json:"content"`
+}
+
+type contentBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`          // tool_use
+	Name      string          `json:"name,omitempty"`        // tool_use
+	Input     json.RawMessage `json:"input,omitempty"`       // tool_use
+	ToolUseID string          `json:"tool_use_id,omitempty"` // tool_result
+	Content   string          `json:"content,omitempty"`     // tool_result
+	Source    *imageSource    `json:"source,omitempty"`      // image
+}
+
+type imageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+// toolChoice tells whether the model may, must or must not call the tools.
+type toolChoice struct {
+	Type string `json:"type"` // auto, any or none.
+}
+
+type tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type response struct {
+	ID         string         `json:"id"`
+	Type       string         `json:"type"`
+	Role       string         `json:"role"`
+	Model      string         `json:"model"`
+	Content    []contentBlock `json:"content"`
+	StopReason string         `json:"stop_reason"`
+	Usage      usage          `json:"usage"`
+	Error      apiError       `json:"error"`
+}
+
+type usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type apiError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+func (a *Anthropic) MessagesURL() (string, error) {
+	return url.JoinPath("https://", a.HostName, "v1/messages")
+}
+
+func (a *Anthropic) ModelsURL() (string, error) {
+	return url.JoinPath("https://", a.HostName, "v1/models")
+}
+
+// authorize sets the credentials and the API version on req.
+func (a *Anthropic) authorize(req *http.Request) {
+	req.Header.Set("x-api-key", a.ApiKey)
+	req.Header.Set("anthropic-version", a.Version)
+}
+
+// Ping checks that the API can be reached with the configured credentials, by listing the models. It is not retried.
+func (a *Anthropic) Ping(ctx context.Context) error {
+	url, err := a.ModelsURL()
+	if err != nil {
+		return fmt.Errorf("cannot assemble endpoint url: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("cannot create request: %w", err)
+	}
+	a.authorize(req)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return openai.WrapTimeout(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return parseError(resp)
+	}
+	return nil
+}
+
+// Completion answers cReq with the Messages API.
+func (a *Anthropic) Completion(ctx context.Context, cReq *openai.CompletionRequest) (*openai.CompletionResponse, error) {
+	var resp response
+	err := a.send(ctx, newRequest(cReq), func(body io.Reader) error {
+		err := json.NewDecoder(body).Decode(&resp)
+		if err != nil {
+			return fmt.Errorf("cannot parse response body: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.toCompletionResponse(), nil
+}
+
+// CompletionStream answers cReq with a streamed response of the Messages API. onDelta is called with every piece
+// of the text as it arrives.
+func (a *Anthropic) CompletionStream(ctx context.Context, cReq *openai.CompletionRequest, onDelta func(delta string)) (*openai.CompletionResponse, error) {
+	req := newRequest(cReq)
+	req.Stream = true
+
+	var resp response
+	partialJSON := make(map[int]string)
+	err := a.send(ctx, req, func(body io.Reader) error {
+		return openai.ReadEvents(body, func(data []byte) error {
+			var ev event
+			err := json.Unmarshal(data, &ev)
+			if err != nil {
+				return fmt.Errorf("cannot parse stream event: %w", err)
+			}
+
+			switch ev.Type {
+			case "message_start":
+				resp = ev.Message
+			case "content_block_start":
+				for len(resp.Content) <= ev.Index {
+					resp.Content = append(resp.Content, contentBlock{})
+				}
+				resp.Content[ev.Index] = ev.ContentBlock
+			case "content_block_delta":
+				if ev.Index >= len(resp.Content) {
+					return fmt.Errorf("delta of unknown content block %d", ev.Index)
+				}
+				switch ev.Delta.Type {
+				case "text_delta":
+					resp.Content[ev.Index].Text += ev.Delta.Text
+					onDelta(ev.Delta.Text)
+				case "input_json_delta":
+					partialJSON[ev.Index] += ev.Delta.PartialJSON
+				}
+			case "message_delta":
+				resp.StopReason = ev.Delta.StopReason
+				resp.Usage.OutputTokens = ev.Usage.OutputTokens
+			case "error":
+				return newError(streamErrorStatuses[ev.Error.Type], ev.Error)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for index, input := range partialJSON {
+		resp.Content[index].Input = json.RawMessage(input)
+	}
+	return resp.toCompletionResponse(), nil
+}
+
+// event is a server-sent event of a streamed response.
+type event struct {
+	Type         string       `json:"type"`
+	Message      response     `json:"message"`       // message_start
+	Index        int          `json:"index"`         // content_block_start, content_block_delta
+	ContentBlock contentBlock `json:"content_block"` // content_block_start
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"` // content_block_delta, message_delta
+	Usage usage    `json:"usage"` // message_delta
+	Error apiError `json:"error"`
+}
+
+func (a *Anthropic) send(ctx context.Context, req *request, handle func(body io.Reader) error) error {
+	url, err := a.MessagesURL()
+	if err != nil {
+		return fmt.Errorf("cannot assemble endpoint url: %w", err)
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("cannot marshal request body: %w", err)
+	}
+
+	policy := retry.Policy{
+		MaxRetries: a.MaxRetries,
+		Delay:      a.RetryDelay,
+		Timeout:    a.RequestTimeout,
+	}
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		a.authorize(req)
+		return req, nil
+	}
+
+	client := &http.Client{}
+	err = policy.Do(ctx, client, newRequest, func(resp *http.Response) error {
+		if resp.StatusCode != 200 {
+			err := parseError(resp)
+			// 529 means the API is overloaded.
+			if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+				return retry.Retryable(err, retry.ParseRetryAfter(resp.Header.Get("Retry-After")))
+			}
+			return err
+		}
+		return handle(resp.Body)
+	})
+	return openai.WrapTimeout(err)
+}
+
+// streamErrorStatuses are the statuses of the errors that can be reported in a stream, which has a 200 status.
+var streamErrorStatuses = map[string]int{
+	"overloaded_error": 529,
+	"api_error":        http.StatusInternalServerError,
+	"rate_limit_error": http.StatusTooManyRequests,
+}
+
+func parseError(resp *http.Response) error {
+	var errResponse response
+	err := json.NewDecoder(resp.Body).Decode(&errResponse)
+	if err != nil {
+		return openai.NewAPIError(resp.StatusCode, openai.HTTPError{Message: http.StatusText(resp.StatusCode)})
+	}
+	return newError(resp.StatusCode, errResponse.Error)
+}
+
+// newError returns the typed error of the openai package that matches an error of the API, so the errors of both
+// providers are handled alike.
+func newError(status int, e apiError) error {
+	if strings.Contains(e.Message, "prompt is too long") {
+		return openai.NewErrorContextLengthExceeded(e.Message)
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return openai.NewAPIError(status, openai.HTTPError{Type: e.Type, Message: e.Message})
+}
+
+// newRequest converts cReq to the format of the Messages API. The system messages are joined into the system
+// prompt, the tool results are sent as user messages and consecutive messages of the same role are merged, because
+// the API requires the roles to alternate.
+func newRequest(cReq *openai.CompletionRequest) *request {
+	req := &request{
+		Model:       cReq.Model,
+		MaxTokens:   DefaultMaxTokens,
+		Temperature: cReq.Temperature,
+		TopP:        cReq.TopP,
+	}
+	if cReq.MaxTokens != nil {
+		req.MaxTokens = *cReq.MaxTokens
+	}
+	if cReq.User != nil {
+		req.Metadata = &metadata{UserId: *cReq.User}
+	}
+	for _, t := range cReq.Tools {
+		schema := t.Function.Parameters
+		if len(schema) == 0 {
+			schema = json.RawMessage(`{"type": "object", "properties": {}}`)
+		}
+		req.Tools = append(req.Tools, tool{
+			Name:        t.Function.Name,
+			Description: t.Function.Description,
+			InputSchema: schema,
+		})
+	}
+	// The tools are sent even if they must not be called, because the history may contain tool calls, and they are
+	// rejected without the definitions.
+	switch {
+	case len(req.Tools) == 0:
+	case cReq.ToolChoice == "none":
+		req.ToolChoice = &toolChoice{Type: "none"}
+	case cReq.ToolChoice == "required":
+		req.ToolChoice = &toolChoice{Type: "any"}
+	}
+
+	var system []string
+	for _, m := range cReq.Messages {
+		var role string
+		var blocks []contentBlock
+		switch m.Role {
+		case "system":
+			system = append(system, m.Content)
+			continue
+		case "tool":
+			role = "user"
+			blocks = append(blocks, contentBlock{
+				Type:      "tool_result",
+				ToolUseID: m.ToolCallID,
+				Content:   m.Content,
+			})
+		case "assistant":
+			role = "assistant"
+			if m.Content != "" {
+				blocks = append(blocks, contentBlock{Type: "text", Text: m.Content})
+			}
+			for _, call := range m.ToolCalls {
+				input := json.RawMessage(call.Function.Arguments)
+				if !json.Valid(input) {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, contentBlock{
+					Type:  "tool_use",
+					ID:    call.ID,
+					Name:  call.Function.Name,
+					Input: input,
+				})
+			}
+		default:
+			role = "user"
+			for _, image := range m.Images {
+				blocks = append(blocks, contentBlock{
+					Type: "image",
+					Source: &imageSource{
+						Type:      "base64",
+						MediaType: image.MediaType,
+						Data:      base64.StdEncoding.EncodeToString(image.Data),
+					},
+				})
+			}
+			if m.Content != "" {
+				blocks = append(blocks, contentBlock{Type: "text", Text: m.Content})
+			}
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+
+		if last := len(req.Messages) - 1; last >= 0 && req.Messages[last].Role == role {
+			req.Messages[last].Content = append(req.Messages[last].Content, blocks...)
+		} else {
+			req.Messages = append(req.Messages, message{Role: role, Content: blocks})
+		}
+	}
+	req.System = strings.Join(system, "\n\n")
+	return req
+}
+
+// toCompletionResponse converts resp to the format of the openai package.
+func (resp *response) toCompletionResponse() *openai.CompletionResponse {
+	answer := openai.Message{Role: "assistant"}
+	var text []string
+	for _, block := range resp.Content {
+		switch block.Type {
+		case "text":
+			text = append(text, block.Text)
+		case "tool_use":
+			input := string(block.Input)
+			if input == "" {
+				input = "{}"
+			}
+			answer.ToolCalls = append(answer.ToolCalls, openai.ToolCall{
+				ID:   block.ID,
+				Type: "function",
+				Function: openai.FunctionCall{
+					Name:      block.Name,
+					Arguments: input,
+				},
+			})
+		}
+	}
+	answer.Content = strings.Join(text, "")
+
+	finishReason := resp.StopReason
+	switch resp.StopReason {
+	case "end_turn", "stop_sequence":
+		finishReason = "stop"
+	case "max_tokens":
+		finishReason = "length"
+	case "tool_use":
+		finishReason = "tool_calls"
+	}
+
+	return &openai.CompletionResponse{
+		ID:     resp.ID,
+		Object: "chat.completion",
+		Model:  resp.Model,
+		Choices: []openai.Choice{{
+			FinishReason: finishReason,
+			Message:      answer,
+		}},
+		Usage: openai.Usage{
+			PromptTokens:     resp.Usage.InputTokens,
+			CompletionTokens: resp.Usage.OutputTokens,
+			TotalTokens:      resp.Usage.InputTokens + resp.Usage.OutputTokens,
+		},
+	}
+}
@@ -0,0 +1,92 @@
+package anthropic
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRequest(t *testing.T) {
+	req := newRequest(&openai.CompletionRequest{
+		Model: "claude-3-haiku-20240307",
+		Messages: []openai.Message{
+			{Role: "system", Content: "You are a bartender."},
+			{Role: "user", Content: "Who is here?"},
+			{Role: "assistant", ToolCalls: []openai.ToolCall{{
+				ID:       "call_1",
+				Type:     "function",
+				Function: openai.FunctionCall{Name: "list_room_members", Arguments: `{}`},
+			}}},
+			{Role: "tool", ToolCallID: "call_1", Content: "alice, bob"},
+			{Role: "user", Content: "And now?"},
+		},
+	})
+
+	assert.Equal(t, "You are a bartender.", req.System)
+	assert.Equal(t, DefaultMaxTokens, req.MaxTokens)
+	if assert.Len(t, req.Messages, 3) {
+		assert.Equal(t, "user", req.Messages[0].Role)
+		assert.Equal(t, "assistant", req.Messages[1].Role)
+		assert.Equal(t, "tool_use", req.Messages[1].Content[0].Type)
+		assert.Equal(t, json.RawMessage(`{}`), req.Messages[1].Content[0].Input)
+		// The tool result and the next question are merged into one user message.
+		assert.Equal(t, "user", req.Messages[2].Role)
+		if assert.Len(t, req.Messages[2].Content, 2) {
+			assert.Equal(t, "tool_result", req.Messages[2].Content[0].Type)
+			assert.Equal(t, "call_1", req.Messages[2].Content[0].ToolUseID)
+			assert.Equal(t, "And now?", req.Messages[2].Content[1].Text)
+		}
+	}
+	assert.Nil(t, req.ToolChoice)
+}
+
+func TestNewRequestToolChoiceNone(t *testing.T) {
+	// The forced final answer after the tool calls: the tools must be sent with the tool_use blocks of the history.
+	req := newRequest(&openai.CompletionRequest{
+		Model: "claude-3-haiku-20240307",
+		Messages: []openai.Message{
+			{Role: "user", Content: "Who is here?"},
+			{Role: "assistant", ToolCalls: []openai.ToolCall{{
+				ID:       "call_1",
+				Type:     "function",
+				Function: openai.FunctionCall{Name: "list_room_members", Arguments: `{}`},
+			}}},
+			{Role: "tool", ToolCallID: "call_1", Content: "alice, bob"},
+		},
+		Tools:      []openai.Tool{{Type: "function", Function: openai.FunctionDefinition{Name: "list_room_members"}}},
+		ToolChoice: "none",
+	})
+
+	if assert.Len(t, req.Tools, 1) {
+		assert.Equal(t, "list_room_members", req.Tools[0].Name)
+	}
+	assert.Equal(t, &toolChoice{Type: "none"}, req.ToolChoice)
+	data, err := json.Marshal(req)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"tool_choice":{"type":"none"}`)
+}
+
+func TestToCompletionResponse(t *testing.T) {
+	resp := response{
+		ID:    "msg_1",
+		Model: "claude-3-haiku-20240307",
+		Content: []contentBlock{
+			{Type: "text", Text: "Let me check."},
+			{Type: "tool_use", ID: "toolu_1", Name: "get_message", Input: json.RawMessage(`{"id":"abc"}`)},
+		},
+		StopReason: "tool_use",
+		Usage:      usage{InputTokens: 10, OutputTokens: 5},
+	}
+
+	cresp := resp.toCompletionResponse()
+	assert.Equal(t, "tool_calls", cresp.Choices[0].FinishReason)
+	assert.Equal(t, "Let me check.", cresp.Choices[0].Message.Content)
+	if assert.Len(t, cresp.Choices[0].Message.ToolCalls, 1) {
+		assert.Equal(t, "toolu_1", cresp.Choices[0].Message.ToolCalls[0].ID)
+		assert.Equal(t, `{"id":"abc"}`, cresp.Choices[0].Message.ToolCalls[0].Function.Arguments)
+	}
+	assert.Equal(t, 15, cresp.Usage.TotalTokens)
+}
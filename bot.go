@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+)
+
+// ChatProvider answers chat completion requests. The OpenAI client and its compatible servers implement it, other
+// providers translate from and to the format of the openai package.
+type ChatProvider interface {
+	Completion(ctx context.Context, cReq *openai.CompletionRequest) (*openai.CompletionResponse, error)
+	CompletionStream(ctx context.Context, cReq *openai.CompletionRequest, onDelta func(delta string)) (*openai.CompletionResponse, error)
+	// Ping checks that the provider can be reached with the configured credentials.
+	Ping(ctx context.Context) error
+}
+
+// Moderator checks texts with a moderation endpoint. The OpenAI client implements it.
+type Moderator interface {
+	Moderation(ctx context.Context, mReq *openai.ModerationRequest) (*openai.ModerationResponse, error)
+}
+
+// Bot answers the messages addressed to it, either by running the command in them or by asking the model.
+type Bot struct {
+	Config        *config.Config
+	Rocket        *rocket.RocketCon
+	Chat          ChatProvider   // Answers the completion requests.
+	OpenAI        *openai.OpenAI // Holds the settings of the completions.
+	Moderator     Moderator      // Nil if no moderation server can be used with the provider.
+	History       *History
+	HistorySize   int // The history size of the rooms without their own. History.Size is the largest of all rooms.
+	Rooms         *RoomState
+	Commands      *CommandRouter
+	Tools         *ToolRegistry
+	Limits        *Limits
+	Usage         UsageStore        // Records the usage of the completions. Nil if the usage is not recorded.
+	EnabledTools  []string          // The names of the tools sent to the model.
+	MaxToolCalls  int               // The number of completions that may call tools before the model has to answer.
+	Personas      map[string]string // Preprompts that can be selected with !persona, by name.
+	AllowedModels []string          // Models that can be selected with !model. If empty, any model can be selected.
+	StartThreads  bool              // Answer the messages in the main timeline of rooms in a new thread.
+	Admins        []string          // The usernames of the users who can run the admin commands.
+	Pricing       map[string]config.Price
+	Messages      *Messages // The templates of the messages of the bot.
+
+	// Summarize condenses the older turns of long conversations into a summary, instead of forgetting them.
+	Summarize          bool
+	SummarizeThreshold int    // The number of history messages that triggers the summary. 0 means the history size.
+	SummarizeKeep      int    // The number of recent messages that are not summarized.
+	SummarizeModel     string // Empty means the model of the room.
+	SummaryPrompt      string
+}
+
+func NewBotFromConfig(cfg *config.Config, rock *rocket.RocketCon, chat ChatProvider, oa *openai.OpenAI, hist *History) *Bot {
+	b := &Bot{
+		Config:        cfg,
+		Rocket:        rock,
+		Chat:          chat,
+		OpenAI:        oa,
+		Moderator:     newModerator(cfg, oa),
+		History:       hist,
+		HistorySize:   cfg.OpenAI.HistorySize,
+		Rooms:         NewRoomState(),
+		Commands:      NewCommandRouter(),
+		Tools:         NewToolRegistry(),
+		Limits:        NewLimitsFromConfig(cfg, NewMemoryCounterStore()),
+		EnabledTools:  cfg.OpenAI.Tools,
+		MaxToolCalls:  cfg.OpenAI.MaxToolCalls,
+		Personas:      cfg.Personas,
+		AllowedModels: cfg.OpenAI.AllowedModels,
+		StartThreads:  cfg.RocketChat.StartThreads,
+		Admins:        cfg.Admins,
+		Pricing:       cfg.Usage.Pricing,
+		Messages:      DefaultMessages(),
+
+		Summarize:          cfg.OpenAI.Summarize,
+		SummarizeThreshold: cfg.OpenAI.SummarizeThreshold,
+		SummarizeKeep:      cfg.OpenAI.SummarizeKeep,
+		SummarizeModel:     cfg.OpenAI.SummarizeModel,
+		SummaryPrompt:      cfg.OpenAI.SummaryPrompt,
+	}
+	if b.SummaryPrompt == "" {
+		b.SummaryPrompt = DefaultSummaryPrompt
+	}
+	registerBuiltinCommands(b.Commands)
+	registerBuiltinTools(b.Tools)
+	return b
+}
+
+// Handle answers msg. The replies go to the thread chosen by InThread.
+func (b *Bot) Handle(ctx context.Context, msg rocket.Message) error {
+	msg = b.InThread(msg)
+	if handled, err := b.Commands.Route(ctx, b, msg); handled {
+		return err
+	}
+	return b.OpenAIResponse(ctx, msg)
+}
+
+// InThread returns msg as it should be answered: if StartThreads is set, a message in the main timeline of a room is
+// treated as the start of its own thread, so the replies and the history of the conversation go there.
+func (b *Bot) InThread(msg rocket.Message) rocket.Message {
+	if b.StartThreads && msg.ThreadId == "" && !msg.IsDirect {
+		msg.ThreadId = msg.Id
+	}
+	return msg
+}
+
+// IsAdmin tells whether the author of msg can run the admin commands.
+func (b *Bot) IsAdmin(msg rocket.Message) bool {
+	return contains(b.Admins, msg.UserName)
+}
+
+// RoomSettings are the settings used to answer in a room.
+type RoomSettings struct {
+	Model            string
+	Persona          string // The name of the persona, empty if the preprompt of the configuration is used.
+	PrePrompt        string
+	HistorySize      int
+	InputModeration  bool
+	OutputModeration bool
+	Vision           bool
+	Locale           string // The locale of the messages of the bot.
+	ModelParams      config.ModelParams
+}
+
+// Settings returns the settings of the room of msg: the global configuration, overridden by the configuration of the
+// room, overridden by what was set with commands.
+func (b *Bot) Settings(msg rocket.Message) RoomSettings {
+	settings := RoomSettings{
+		Model:            b.OpenAI.Model,
+		PrePrompt:        b.OpenAI.PrePrompt,
+		HistorySize:      b.HistorySize,
+		InputModeration:  b.OpenAI.InputModeration,
+		OutputModeration: b.OpenAI.OutputModeration,
+		Vision:           b.OpenAI.Vision,
+		Locale:           DefaultLocale,
+		ModelParams:      b.OpenAI.ModelParams,
+	}
+
+	if b.Config != nil {
+		if b.Config.Locale != "" {
+			settings.Locale = b.Config.Locale
+		}
+		if room, ok := b.Config.Room(msg.RoomName, msg.RoomId); ok {
+			if room.Model != nil {
+				settings.Model = *room.Model
+			}
+			if room.PrePrompt != nil {
+				settings.PrePrompt = strings.TrimSpace(*room.PrePrompt)
+			}
+			if room.HistorySize != nil {
+				settings.HistorySize = *room.HistorySize
+			}
+			if room.InputModeration != nil {
+				settings.InputModeration = *room.InputModeration
+			}
+			if room.OutputModeration != nil {
+				settings.OutputModeration = *room.OutputModeration
+			}
+			if room.Vision != nil {
+				settings.Vision = *room.Vision
+			}
+			if room.Locale != nil {
+				settings.Locale = *room.Locale
+			}
+			settings.ModelParams = settings.ModelParams.Merge(room.ModelParams)
+		}
+	}
+
+	state := b.Rooms.Get(msg.RoomId)
+	if state.Model != "" {
+		settings.Model = state.Model
+	}
+	if prePrompt, ok := b.Personas[state.Persona]; ok {
+		settings.Persona = state.Persona
+		settings.PrePrompt = prePrompt
+	}
+	return settings
+}
+
+// history returns the history of the conversation of msg, limited to the history size of the room.
+func (b *Bot) history(msg rocket.Message, settings RoomSettings) []openai.Message {
+	history := b.History.AsOpenAIMessages(conversationPlace(msg))
+	if len(history) > settings.HistorySize {
+		if settings.HistorySize > 0 && isSummary(history[0]) {
+			// Keep the summary of the older turns.
+			return append(history[:1:1], history[len(history)-settings.HistorySize+1:]...)
+		}
+		history = history[len(history)-settings.HistorySize:]
+	}
+	return history
+}
+
+// conversationPlace returns the key of the conversation of msg in the history. Every thread is a separate
+// conversation.
+func conversationPlace(msg rocket.Message) string {
+	if msg.ThreadId != "" {
+		return msg.RoomName + "/" + msg.ThreadId
+	}
+	return msg.RoomName
+}
+
+// RoomOverride is what was changed with commands in a room.
+type RoomOverride struct {
+	Model   string
+	Persona string
+}
+
+// RoomState keeps the settings changed with commands, per room id.
+type RoomState struct {
+	rooms map[string]RoomOverride
+	mutex sync.RWMutex
+}
+
+func NewRoomState() *RoomState {
+	return &RoomState{
+		rooms: make(map[string]RoomOverride),
+	}
+}
+
+func (s *RoomState) Get(roomId string) RoomOverride {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.rooms[roomId]
+}
+
+// Update changes the override of roomId with update.
+func (s *RoomState) Update(roomId string, update func(override *RoomOverride)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	override := s.rooms[roomId]
+	update(&override)
+	s.rooms[roomId] = override
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBotSettings(t *testing.T) {
+	temperature, lowTemperature, maxTokens := 0.9, 0.1, 512
+	supportModel, supportPrompt, historySize := "gpt-4", "You are the support assistant.", 40
+	moderation := false
+	locale := "hu"
+
+	cfg := &config.Config{
+		Rooms: map[string]config.RoomConfig{
+			"support": {
+				Model:           &supportModel,
+				PrePrompt:       &supportPrompt,
+				HistorySize:     &historySize,
+				InputModeration: &moderation,
+				Locale:          &locale,
+				ModelParams:     config.ModelParams{Temperature: &lowTemperature},
+			},
+		},
+		Locale:   "de",
+		Personas: map[string]string{"pirate": "You are a pirate."},
+	}
+	oa := &openai.OpenAI{
+		Model:           "gpt-3.5-turbo",
+		PrePrompt:       "You are a cowboy.",
+		InputModeration: true,
+		ModelParams:     config.ModelParams{Temperature: &temperature, MaxTokens: &maxTokens},
+	}
+	cfg.OpenAI.HistorySize = 6
+	hist := NewHistoryFromConfig(cfg, NewMemoryHistoryStore())
+	b := NewBotFromConfig(cfg, nil, oa, oa, hist)
+	assert.Equal(t, 40, hist.Size, "the history keeps enough messages for every room")
+
+	random := rocket.Message{RoomName: "random", RoomId: "r1"}
+	assert.Equal(t, RoomSettings{
+		Model:           "gpt-3.5-turbo",
+		PrePrompt:       "You are a cowboy.",
+		HistorySize:     6,
+		InputModeration: true,
+		Locale:          "de",
+		ModelParams:     config.ModelParams{Temperature: &temperature, MaxTokens: &maxTokens},
+	}, b.Settings(random))
+
+	support := rocket.Message{RoomName: "support", RoomId: "r2"}
+	assert.Equal(t, RoomSettings{
+		Model:           "gpt-4",
+		PrePrompt:       "You are the support assistant.",
+		HistorySize:     40,
+		InputModeration: false,
+		Locale:          "hu",
+		ModelParams:     config.ModelParams{Temperature: &lowTemperature, MaxTokens: &maxTokens},
+	}, b.Settings(support))
+
+	// What is set with commands wins over the configuration.
+	b.Rooms.Update("r2", func(override *RoomOverride) {
+		override.Model = "gpt-4-32k"
+		override.Persona = "pirate"
+	})
+	settings := b.Settings(support)
+	assert.Equal(t, "gpt-4-32k", settings.Model)
+	assert.Equal(t, "pirate", settings.Persona)
+	assert.Equal(t, "You are a pirate.", settings.PrePrompt)
+}
+
+func TestConversationPlace(t *testing.T) {
+	assert.Equal(t, "general", conversationPlace(rocket.Message{RoomName: "general", Id: "m1"}))
+	assert.Equal(t, "general/m0", conversationPlace(rocket.Message{RoomName: "general", Id: "m1", ThreadId: "m0"}))
+}
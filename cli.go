@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+)
+
+// runSubcommand runs the subcommand in args (the command line arguments without the program name) with the
+// configuration file at configFile, and returns its exit code.
+func runSubcommand(configFile string, args []string) int {
+	switch args[0] {
+	case "usage":
+		cfg, err := config.NewConfig(configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		setLogLevel(cfg.LogLevel)
+		return usageSubcommand(cfg, args[1:])
+	case "check-config":
+		return checkConfigSubcommand(configFile, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown subcommand: %s. Subcommands: usage, check-config\n", args[0])
+		return 2
+	}
+}
+
+// usageSubcommand prints the usage report from the database.
+func usageSubcommand(cfg *config.Config, args []string) int {
+	flags := flag.NewFlagSet("usage", flag.ContinueOnError)
+	by := flags.String("by", "user", "group by user, room, day or model")
+	days := flags.Int("days", 30, "report the last this many days")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	db, err := openDatabase(cfg.Database.Path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	store, err := NewBoltUsageStore(db)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	to := time.Now()
+	records, err := store.List(to.AddDate(0, 0, -*days), to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	report, err := UsageReport(records, *by, cfg.Usage.Pricing)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Print(FormatUsageReport(report, *by))
+	return 0
+}
+
+// checkConfigSubcommand reports the problems of the configuration file, including the keys that cannot be parsed.
+// With -connect, it also logs in to Rocket.Chat and pings the chat provider.
+func checkConfigSubcommand(configFile string, args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	connect := flags.Bool("connect", false, "also log in to Rocket.Chat and ping the chat provider")
+	timeout := flags.Duration("timeout", 30*time.Second, "the timeout of the ping")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := config.Check(configFile)
+	if cfg != nil {
+		setLogLevel(cfg.LogLevel)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if !checkConfig(ctx, cfg, err, *connect, os.Stdout) {
+		return 1
+	}
+	return 0
+}
+
+// checkConfig writes a report about cfg to w, and returns whether everything is fine. checkErr is the result of
+// loading and validating cfg; cfg is nil if it could not be loaded at all. If connect is set and the configuration is
+// valid, the Rocket.Chat login and the chat provider are tested too.
+func checkConfig(ctx context.Context, cfg *config.Config, checkErr error, connect bool, w io.Writer) bool {
+	var problems []string
+	var validationErr *config.ValidationError
+	if errors.As(checkErr, &validationErr) {
+		problems = append(problems, validationErr.Problems...)
+	} else if checkErr != nil {
+		problems = append(problems, checkErr.Error())
+	}
+	if cfg != nil {
+		if _, err := NewMessages(cfg.Messages); err != nil {
+			problems = append(problems, err.Error())
+		}
+		problems = append(problems, checkMessages(cfg)...)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintln(w, "The configuration is invalid:")
+		for _, problem := range problems {
+			fmt.Fprintln(w, "  "+problem)
+		}
+		return false
+	}
+	fmt.Fprintln(w, "The configuration is valid.")
+	if !connect {
+		return true
+	}
+
+	ok := true
+	rock, err := rocket.NewConnectionFromConfig(cfg)
+	if err != nil {
+		fmt.Fprintf(w, "Cannot log in to Rocket.Chat: %s\n", err)
+		ok = false
+	} else {
+		fmt.Fprintf(w, "Logged in to Rocket.Chat as %s.\n", rock.UserName)
+		rock.Close()
+	}
+
+	oa := openai.NewFromConfig(cfg)
+	chat, err := newChatProvider(cfg, oa)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return false
+	}
+	if err := chat.Ping(ctx); err != nil {
+		fmt.Fprintf(w, "Cannot reach the chat provider: %s\n", err)
+		ok = false
+	} else {
+		fmt.Fprintln(w, "The chat provider answers.")
+	}
+	if moderator, isClient := newModerator(cfg, oa).(*openai.OpenAI); isClient && moderator != oa {
+		if err := moderator.Ping(ctx); err != nil {
+			fmt.Fprintf(w, "Cannot reach the moderation server: %s\n", err)
+			ok = false
+		} else {
+			fmt.Fprintln(w, "The moderation server answers.")
+		}
+	}
+	return ok
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/openai/openaitest"
+	"github.com/mimrock/rocketchat_openai_bot/rocket/rockettest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckConfig(t *testing.T) {
+	rc := rockettest.NewServer(rockettest.User{ID: "bot-id", UserName: "bartender", Password: "secret"})
+	defer rc.Close()
+	oa := openaitest.NewServer()
+	defer oa.Close()
+
+	cfg := rc.Config()
+	oa.Configure(cfg)
+	cfg.Workers = 1
+	cfg.Locale = "en"
+	cfg.OpenAI.Model = "gpt-3.5-turbo"
+
+	var out bytes.Buffer
+	assert.True(t, checkConfig(context.Background(), cfg, cfg.Validate(), true, &out), out.String())
+	assert.Equal(t, "The configuration is valid.\nLogged in to Rocket.Chat as bartender.\nThe chat provider answers.\n", out.String())
+
+	out.Reset()
+	cfg.RocketChat.Password = "wrong"
+	cfg.OpenAI.ApiToken = "wrong"
+	assert.False(t, checkConfig(context.Background(), cfg, cfg.Validate(), true, &out))
+	assert.Contains(t, out.String(), "Cannot log in to Rocket.Chat")
+	assert.Contains(t, out.String(), "Cannot reach the chat provider")
+
+	// Nothing is contacted if the configuration is invalid.
+	out.Reset()
+	cfg.OpenAI.Model = ""
+	cfg.Messages = map[string]map[string]string{"en": {"reset": "{{.Nickname}}"}}
+	assert.False(t, checkConfig(context.Background(), cfg, cfg.Validate(), true, &out))
+	assert.Contains(t, out.String(), "The configuration is invalid:\n  OpenAI.Model is required\n")
+	assert.Contains(t, out.String(), "Nickname")
+	assert.NotContains(t, out.String(), "Rocket.Chat")
+
+	// The messages the bot does not have are reported.
+	out.Reset()
+	cfg.OpenAI.Model = "gpt-3.5-turbo"
+	cfg.Messages = map[string]map[string]string{"en": {"reset": "Forgot it.", "rest": "Forgot it."}}
+	assert.False(t, checkConfig(context.Background(), cfg, cfg.Validate(), false, &out))
+	assert.Equal(t, "The configuration is invalid:\n  Messages.en.rest is not a message of the bot\n", out.String())
+
+	// So are the locales without a translation, unless every message is overridden. The language of a regional
+	// locale is enough.
+	out.Reset()
+	cfg.Messages = nil
+	cfg.Locale = "de-AT"
+	french := "fr"
+	cfg.Rooms = map[string]config.RoomConfig{"general": {Locale: &french}}
+	assert.False(t, checkConfig(context.Background(), cfg, cfg.Validate(), false, &out))
+	assert.Regexp(t, `^The configuration is invalid:\n  Rooms.general.Locale: there is no translation for fr, and Messages.fr leaves out \d+ messages\n$`, out.String())
+
+	out.Reset()
+	cfg.Messages = map[string]map[string]string{"fr": {}}
+	for name := range DefaultMessages().templates[DefaultLocale] {
+		cfg.Messages["fr"][name] = "Bonjour."
+	}
+	assert.True(t, checkConfig(context.Background(), cfg, cfg.Validate(), false, &out), out.String())
+
+	// The keys that cannot be parsed are reported with the other problems.
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("Workers: 0\nOpenAI:\n  Modell: gpt-4o\n  RequestTimeout: 2 minutes\n"), 0600))
+	out.Reset()
+	cfg, err := config.Check(path)
+	assert.False(t, checkConfig(context.Background(), cfg, err, false, &out))
+	assert.Contains(t, out.String(), "field Modell not found")
+	assert.Contains(t, out.String(), "2 minutes")
+	assert.Contains(t, out.String(), "  Workers must be at least 1, not 0\n")
+
+	out.Reset()
+	cfg, err = config.Check(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.False(t, checkConfig(context.Background(), cfg, err, false, &out))
+	assert.Contains(t, out.String(), "cannot read configfile")
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"path"
+	"strings"
 	"time"
 
+	"github.com/mimrock/rocketchat_openai_bot/metrics"
 	"github.com/mimrock/rocketchat_openai_bot/openai"
 	"github.com/mimrock/rocketchat_openai_bot/rocket"
 
@@ -30,60 +34,121 @@ func DemoResponse(msg rocket.Message) {
 	msg.React(":grinning:")
 }
 
-func OpenAIResponse(rocketmsg rocket.Message, oa *openai.OpenAI, hist *History) error {
+func (b *Bot) OpenAIResponse(ctx context.Context, rocketmsg rocket.Message) error {
+	oa, hist := b.OpenAI, b.History
+	settings := b.Settings(rocketmsg)
+
 	msg := openai.Message{
 		Role:    "user",
 		Content: rocketmsg.GetNotAddressedText(),
 	}
+	err := b.Limits.Check(rocketmsg.UserId, rocketmsg.RoomId)
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return reply(rocketmsg, b.limitText(rocketmsg, limitErr))
+	} else if err != nil {
+		return fmt.Errorf("cannot check the limits: %w", err)
+	}
+
 	rocketmsg.SetIsTyping(true)
 	defer func() {
 		rocketmsg.SetIsTyping(false)
 	}()
 
-	place := rocketmsg.RoomName
+	if oa.Transcribe {
+		transcript, err := b.transcribe(ctx, rocketmsg)
+		if err != nil {
+			return fmt.Errorf("cannot transcribe the attached recordings: %w", err)
+		}
+		if transcript != "" {
+			if oa.EchoTranscript {
+				_, err = rocketmsg.Reply(fmt.Sprintf("@%s %s", rocketmsg.UserName, b.text(rocketmsg, "transcript", MessageData{Text: transcript})))
+				if err != nil {
+					return fmt.Errorf("cannot send reply to rocketchat: %w", err)
+				}
+			}
+			msg.Content = strings.TrimSpace(msg.Content + "\n\n" + transcript)
+		}
+	}
 
-	if oa.InputModeration {
-		// Send the input to the OpenAI moderation endpoint, and if it is flagged, return an error instead of sending anything to the completion endpoint.
-		mresp, err := oa.Moderation(&openai.ModerationRequest{
-			Input: rocketmsg.GetNotAddressedText(),
-		})
+	if settings.Vision {
+		images, err := b.images(rocketmsg)
 		if err != nil {
-			return fmt.Errorf("cannot perform perliminary request to the moderation endpoint: %w", err)
+			return fmt.Errorf("cannot download the attached images: %w", err)
 		}
+		msg.Images = images
+	}
 
-		log.WithField("moderationResponse", mresp).Debug("Preliminary (input) moderation response.")
+	place := conversationPlace(rocketmsg)
 
-		if mresp.IsFlagged() {
-			// @todo configurable message?
-			_, err = rocketmsg.Reply(fmt.Sprintf("@%s :triangular_flag_on_post: Our bot uses OpenAI's moderation system, which flagged your message as inappropriate. Please try rephrasing your message to avoid any offensive or inappropriate content. REASON: %s :triangular_flag_on_post:",
-				rocketmsg.UserName, mresp.FlaggedReason()))
-			if err != nil {
-				return fmt.Errorf("cannot send reply to rocketchat: %w", err)
-			}
-			return nil
+	if settings.InputModeration {
+		flagged, err := b.moderateInput(ctx, rocketmsg, msg.Content)
+		if err != nil || flagged {
+			return err
 		}
 	}
 
 	var systemMessage = openai.Message{
 		Role:    "system",
-		Content: oa.PrePrompt,
+		Content: settings.PrePrompt,
 	}
 
 	// Prepend the preprompt
-	var messages []openai.Message
-	if len(oa.PrePrompt) > 0 {
-		messages = append(messages, systemMessage)
+	var prompt []openai.Message
+	if len(settings.PrePrompt) > 0 {
+		prompt = append(prompt, systemMessage)
 	}
-	messages = append(messages, hist.AsOpenAIMessages(place)...)
 
-	messages = append(messages, msg)
+	// Drop the oldest turns that would not fit in the context window together with the preprompt, the new message
+	// and the completion.
+	assemble := func(history []openai.Message) []openai.Message {
+		messages := append([]openai.Message{}, prompt...)
+		messages = append(messages, history...)
+		return append(messages, msg)
+	}
+	budget := oa.PromptBudget(settings.Model, settings.ModelParams.MaxTokens)
+	history := dropOldest(b.history(rocketmsg, settings), func(history []openai.Message) bool {
+		if hist.MaxLength > 0 && openai.CountTokens(settings.Model, history) > hist.MaxLength {
+			return false
+		}
+		return openai.CountTokens(settings.Model, assemble(history)) <= budget
+	})
+	messages := assemble(history)
+	metrics.HistoryMessages.Observe(float64(len(history)))
+	if tokens := openai.CountTokens(settings.Model, messages); tokens > budget {
+		log.WithField("tokens", tokens).WithField("budget", budget).Warn("The message does not fit in the context window even without history.")
+	}
 
 	OAUserid := "" // Userid to send OpenAI. If empty, the no UserId is sent.
 	if oa.SendUserId {
 		OAUserid = rocketmsg.UserId
 	}
-	cresp, err := oa.Completion(oa.NewCompletionRequest(messages, OAUserid))
+	cReq := oa.NewCompletionRequest(messages, OAUserid)
+	cReq.Model = settings.Model
+	cReq.Temperature = settings.ModelParams.Temperature
+	cReq.TopP = settings.ModelParams.TopP
+	cReq.MaxTokens = settings.ModelParams.MaxTokens
+	cReq.PresencePenalty = settings.ModelParams.PresencePenalty
+	cReq.FrequencyPenalty = settings.ModelParams.FrequencyPenalty
+	cReq.Tools = b.Tools.Definitions(b.EnabledTools)
+
+	var reply *rocket.Message // The placeholder that is edited while the answer is streamed, if streaming is on.
+	if oa.Stream {
+		placeholder, err := rocketmsg.Reply(fmt.Sprintf("@%s %s", rocketmsg.UserName, b.text(rocketmsg, "thinking", MessageData{})))
+		if err != nil {
+			return fmt.Errorf("cannot send reply to rocketchat: %w", err)
+		}
+		reply = &placeholder
+	}
+
+	cresp, err := b.complete(ctx, rocketmsg, cReq, reply)
 	if err != nil {
+		if reply != nil {
+			// Do not leave the placeholder behind, the error is reported in a new message.
+			if err := reply.Delete(""); err != nil {
+				log.WithError(err).Warn("Cannot delete the placeholder of the streamed reply.")
+			}
+		}
 		if errors.Is(err, &openai.ErrorContextLengthExceeded{}) {
 			// If the reason for the error is context_length_exceeded, we clear history, so it does not happen on the next comment.
 			hist.Clear(place)
@@ -92,46 +157,248 @@ func OpenAIResponse(rocketmsg rocket.Message, oa *openai.OpenAI, hist *History)
 		return fmt.Errorf("cannot perform completion request: %w", err)
 	}
 
-	if len(cresp.Choices) == 0 {
-		return fmt.Errorf("no choices returned")
-	}
-
 	log.WithField("completionResponse", cresp).Trace("Completion response.")
 
-	var response string
+	response := cresp.Choices[0].Message.Content
 	var mresp *openai.ModerationResponse
-	if oa.OutputModeration {
-		mresp, err = oa.Moderation(&openai.ModerationRequest{
-			Input: cresp.Choices[0].Message.Content,
-		})
+	if settings.OutputModeration {
+		mresp, err = b.moderate(ctx, "output", cresp.Choices[0].Message.Content)
 		if err != nil {
 			return fmt.Errorf("cannot perform follow-up request to the moderation endpoint (output check): %w", err)
 		}
 
 		if mresp.IsFlagged() {
-			// @todo better explanation that it is the output that got flagged.
-			response = fmt.Sprintf(":triangular_flag_on_post: (output flagged: %s) :triangular_flag_on_post:", mresp.FlaggedReason())
+			response = b.text(rocketmsg, "output_flagged", MessageData{Reason: mresp.FlaggedReason(), Text: response})
 		}
 
 		log.WithField("moderationResponse", mresp).Trace("Follow-up (output) moderation response.")
 
 	}
 
-	response += cresp.Choices[0].Message.Content
-
 	// @todo further calls if finishReason indicates that the response is not completed.
-	_, err = rocketmsg.Reply(fmt.Sprintf("@%s %s", rocketmsg.UserName, response))
+	if reply != nil {
+		err = reply.EditText(fmt.Sprintf("@%s %s", rocketmsg.UserName, response))
+	} else {
+		_, err = rocketmsg.Reply(fmt.Sprintf("@%s %s", rocketmsg.UserName, response))
+	}
 	if err != nil {
 		return fmt.Errorf("cannot send reply to rocketchat: %w", err)
 	}
 
 	if mresp == nil || !mresp.IsFlagged() {
-		hist.Add(place, msg)
-		hist.Add(place, openai.Message{
+		// The images would take too much space and too many tokens in the history.
+		msg.Images = nil
+		answer := openai.Message{
 			Role:    "assistant",
 			Content: cresp.Choices[0].Message.Content,
-		})
+		}
+		if b.Summarize {
+			// The history is trimmed only after the summary, so the oldest turns are summarized, not dropped.
+			hist.Append(place, msg, answer)
+			err = b.summarizeHistory(ctx, rocketmsg, settings)
+			if err != nil {
+				log.WithError(err).Warn("Cannot summarize the history.")
+			}
+			hist.Trim(place)
+		} else {
+			hist.Add(place, msg)
+			hist.Add(place, answer)
+		}
 	}
 
 	return nil
 }
+
+// moderateInput checks text with the OpenAI moderation endpoint. If it is flagged, the author of rocketmsg is told
+// so, and true is returned, so nothing should be sent to the model.
+func (b *Bot) moderateInput(ctx context.Context, rocketmsg rocket.Message, text string) (bool, error) {
+	mresp, err := b.moderate(ctx, "input", text)
+	if err != nil {
+		return false, fmt.Errorf("cannot perform perliminary request to the moderation endpoint: %w", err)
+	}
+
+	log.WithField("moderationResponse", mresp).Debug("Preliminary (input) moderation response.")
+
+	if !mresp.IsFlagged() {
+		return false, nil
+	}
+	_, err = rocketmsg.Reply(fmt.Sprintf("@%s %s", rocketmsg.UserName, b.text(rocketmsg, "input_flagged", MessageData{Reason: mresp.FlaggedReason()})))
+	if err != nil {
+		return true, fmt.Errorf("cannot send reply to rocketchat: %w", err)
+	}
+	return true, nil
+}
+
+// moderate checks text with the moderation endpoint. kind tells whether text is the input or the output in the
+// metrics.
+func (b *Bot) moderate(ctx context.Context, kind string, text string) (*openai.ModerationResponse, error) {
+	if b.Moderator == nil {
+		return nil, errors.New("no moderation server is configured for the provider, set Moderation.BaseURL")
+	}
+	start := time.Now()
+	mresp, err := b.Moderator.Moderation(ctx, &openai.ModerationRequest{
+		Input: text,
+	})
+	metrics.Since(metrics.OperationModeration, start)
+
+	outcome := metrics.Outcome(err)
+	if err == nil && mresp.IsFlagged() {
+		outcome = metrics.OutcomeFlagged
+		metrics.Flagged.WithLabelValues(kind).Inc()
+	}
+	metrics.Moderations.WithLabelValues(kind, outcome).Inc()
+	return mresp, err
+}
+
+// transcribe returns the text of the recordings attached to rocketmsg.
+func (b *Bot) transcribe(ctx context.Context, rocketmsg rocket.Message) (string, error) {
+	var transcripts []string
+	for _, attach := range rocketmsg.Attachments {
+		if !attach.IsAudio() {
+			continue
+		}
+		data, _, err := b.Rocket.Download(attach.AudioURL)
+		if err != nil {
+			return "", fmt.Errorf("cannot download %s: %w", attach.AudioURL, err)
+		}
+		// The extension of the file name tells the format of the recording.
+		tresp, err := b.OpenAI.Transcription(ctx, &openai.TranscriptionRequest{
+			Model:    b.OpenAI.TranscriptionModel,
+			FileName: path.Base(attach.AudioURL),
+			File:     data,
+		})
+		if err != nil {
+			return "", fmt.Errorf("cannot transcribe %s: %w", attach.AudioURL, err)
+		}
+		log.WithField("recording", attach.AudioURL).WithField("transcript", tresp.Text).Debug("Recording transcribed.")
+		// The transcription endpoint reports no usage, the transcript is counted instead.
+		tokens := openai.CountTextTokens(b.OpenAI.TranscriptionModel, tresp.Text)
+		b.record(rocketmsg, tokens, UsageRecord{Model: b.OpenAI.TranscriptionModel, CompletionTokens: tokens, Estimated: true})
+		transcripts = append(transcripts, strings.TrimSpace(tresp.Text))
+	}
+	return strings.Join(transcripts, "\n\n"), nil
+}
+
+// images downloads the images attached to rocketmsg.
+func (b *Bot) images(rocketmsg rocket.Message) ([]openai.Image, error) {
+	var images []openai.Image
+	for _, attach := range rocketmsg.Attachments {
+		if !attach.IsImage() {
+			continue
+		}
+		data, mediaType, err := b.Rocket.Download(attach.ImageURL)
+		if err != nil {
+			return nil, fmt.Errorf("cannot download %s: %w", attach.ImageURL, err)
+		}
+		if !strings.HasPrefix(mediaType, "image/") {
+			// Some servers serve the uploads as application/octet-stream.
+			mediaType = attach.ImageType
+		}
+		log.WithField("image", attach.ImageURL).WithField("size", len(data)).Debug("Image attached to the question.")
+		images = append(images, openai.Image{MediaType: mediaType, Data: data})
+	}
+	return images, nil
+}
+
+// complete asks the model to answer cReq. If the model calls tools, they are run and the model is asked again with
+// their results, until it answers or MaxToolCalls is reached. If reply is not nil, the answer is streamed into it.
+func (b *Bot) complete(ctx context.Context, rocketmsg rocket.Message, cReq *openai.CompletionRequest, reply *rocket.Message) (*openai.CompletionResponse, error) {
+	for calls := 0; ; calls++ {
+		if calls >= b.MaxToolCalls && len(cReq.Tools) > 0 {
+			// Make the model answer with what it has got so far. The tools stay in the request, because the
+			// messages may contain calls of them.
+			cReq.ToolChoice = "none"
+		}
+
+		var cresp *openai.CompletionResponse
+		var err error
+		start := time.Now()
+		if reply != nil {
+			cresp, err = b.streamResponse(ctx, rocketmsg, *reply, cReq)
+		} else {
+			cresp, err = b.Chat.Completion(ctx, cReq)
+		}
+		metrics.Since(metrics.OperationCompletion, start)
+		metrics.Completions.WithLabelValues(metrics.Outcome(err)).Inc()
+		if err != nil {
+			return nil, err
+		}
+		if len(cresp.Choices) > 0 {
+			b.recordUsage(rocketmsg, cReq, cresp)
+		}
+		if len(cresp.Choices) == 0 {
+			return nil, fmt.Errorf("no choices returned")
+		}
+
+		answer := cresp.Choices[0].Message
+		if len(answer.ToolCalls) == 0 || len(cReq.Tools) == 0 || cReq.ToolChoice == "none" {
+			return cresp, nil
+		}
+
+		cReq.Messages = append(cReq.Messages, answer)
+		for _, call := range answer.ToolCalls {
+			cReq.Messages = append(cReq.Messages, b.Tools.Call(ctx, b, rocketmsg, call))
+		}
+	}
+}
+
+// recordUsage counts the tokens used by the completion in the metrics, the quotas and the usage records.
+func (b *Bot) recordUsage(rocketmsg rocket.Message, cReq *openai.CompletionRequest, cresp *openai.CompletionResponse) {
+	prompt, completion, estimated := usedTokens(cReq, cresp)
+	metrics.Tokens.WithLabelValues(cReq.Model, "prompt").Add(float64(prompt))
+	metrics.Tokens.WithLabelValues(cReq.Model, "completion").Add(float64(completion))
+	b.record(rocketmsg, prompt+completion, UsageRecord{
+		Model:            cReq.Model,
+		PromptTokens:     prompt,
+		CompletionTokens: completion,
+		Estimated:        estimated,
+	})
+}
+
+// record counts tokens toward the quotas of the author and the room of rocketmsg, and adds record to the usage
+// records, filled in with the time, the user and the room.
+func (b *Bot) record(rocketmsg rocket.Message, tokens int, record UsageRecord) {
+	err := b.Limits.Record(rocketmsg.UserId, rocketmsg.RoomId, tokens)
+	if err != nil {
+		log.WithError(err).Warn("Cannot record the used tokens.")
+	}
+	if b.Usage != nil {
+		record.Time = time.Now()
+		record.UserId = rocketmsg.UserId
+		record.UserName = rocketmsg.UserName
+		record.RoomId = rocketmsg.RoomId
+		record.RoomName = rocketmsg.RoomName
+		err = b.Usage.Add(record)
+		if err != nil {
+			log.WithError(err).Warn("Cannot record the usage.")
+		}
+	}
+}
+
+// usedTokens returns the prompt and the completion tokens used by the completion. If the provider does not report
+// the usage, they are estimated.
+func usedTokens(cReq *openai.CompletionRequest, cresp *openai.CompletionResponse) (prompt int, completion int, estimated bool) {
+	if cresp.Usage.TotalTokens > 0 {
+		return cresp.Usage.PromptTokens, cresp.Usage.CompletionTokens, false
+	}
+	return openai.CountTokens(cReq.Model, cReq.Messages),
+		openai.CountTokens(cReq.Model, []openai.Message{cresp.Choices[0].Message}), true
+}
+
+// streamResponse edits reply as the answer of the model arrives. The edits are throttled to one per
+// StreamEditInterval, so Rocket.Chat is not flooded. The final text is left to the caller.
+func (b *Bot) streamResponse(ctx context.Context, rocketmsg rocket.Message, reply rocket.Message, cReq *openai.CompletionRequest) (*openai.CompletionResponse, error) {
+	var text string
+	var lastEdit time.Time
+	return b.Chat.CompletionStream(ctx, cReq, func(delta string) {
+		text += delta
+		if time.Since(lastEdit) < b.OpenAI.StreamEditInterval {
+			return
+		}
+		lastEdit = time.Now()
+		err := reply.EditText(fmt.Sprintf("@%s %s", rocketmsg.UserName, b.text(rocketmsg, "streaming", MessageData{Text: text})))
+		if err != nil {
+			log.WithError(err).Warn("Cannot update the streamed reply.")
+		}
+	})
+}
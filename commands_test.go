@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"github.com/mimrock/rocketchat_openai_bot/openai/openaitest"
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+	"github.com/mimrock/rocketchat_openai_bot/rocket/rockettest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// conversation is a bot talking to alice in direct messages, on fake Rocket.Chat and OpenAI servers.
+type conversation struct {
+	bot    *Bot
+	rocket *rockettest.Server
+	openai *openaitest.Server
+}
+
+func newConversation(t *testing.T, configure func(cfg *config.Config)) *conversation {
+	c := &conversation{
+		rocket: rockettest.NewServer(
+			rockettest.User{ID: "bot-id", UserName: "bartender", Password: "secret"},
+			rockettest.Room{ID: "d1", Name: "alice", Type: "d"},
+		),
+		openai: openaitest.NewServer(),
+	}
+	t.Cleanup(c.rocket.Close)
+	t.Cleanup(c.openai.Close)
+
+	cfg := c.rocket.Config()
+	c.openai.Configure(cfg)
+	cfg.OpenAI.Model = "gpt-3.5-turbo"
+	cfg.OpenAI.PrePrompt = "You are a bartender."
+	cfg.OpenAI.HistorySize = 6
+	cfg.OpenAI.MaxRetries = 2
+	cfg.OpenAI.RetryDelay = 10 * time.Millisecond
+	cfg.OpenAI.RequestTimeout = 5 * time.Second
+	cfg.OpenAI.StreamEditInterval = 10 * time.Millisecond
+	if configure != nil {
+		configure(cfg)
+	}
+
+	rock, err := rocket.NewConnectionFromConfig(cfg)
+	require.NoError(t, err)
+	t.Cleanup(rock.Close)
+	require.NoError(t, c.rocket.WaitSubscribed("d1"))
+
+	oa := openai.NewFromConfig(cfg)
+	hist := NewHistoryFromConfig(cfg, NewMemoryHistoryStore())
+	c.bot = NewBotFromConfig(cfg, rock, oa, oa, hist)
+	return c
+}
+
+// ask sends text to the bot as alice and lets the bot answer it.
+func (c *conversation) ask(t *testing.T, text string) error {
+	c.rocket.Post(rockettest.Message{RoomID: "d1", UserID: "alice-id", UserName: "alice", Text: text})
+	msg, err := c.bot.Rocket.GetNewMessage()
+	require.NoError(t, err)
+	return c.bot.OpenAIResponse(context.Background(), msg)
+}
+
+// answers returns the texts of the messages sent by the bot.
+func (c *conversation) answers() []string {
+	var texts []string
+	for _, msg := range c.rocket.Sent() {
+		texts = append(texts, msg.Text)
+	}
+	return texts
+}
+
+func TestOpenAIResponse(t *testing.T) {
+	c := newConversation(t, func(cfg *config.Config) {
+		cfg.OpenAI.InputModeration = true
+	})
+
+	c.openai.QueueCompletions(openaitest.Completion("What can I get you?"))
+	require.NoError(t, c.ask(t, "Good evening!"))
+	require.NoError(t, c.ask(t, "A whiskey, please."))
+
+	assert.Equal(t, []string{"@alice What can I get you?", "@alice A whiskey, please."}, c.answers())
+	assert.Equal(t, []string{"Good evening!", "A whiskey, please."}, c.openai.ModerationInputs())
+
+	cReqs := c.openai.CompletionRequests()
+	require.Len(t, cReqs, 2)
+	assert.Equal(t, "gpt-3.5-turbo", cReqs[1].Model)
+	assert.Equal(t, []openai.Message{
+		{Role: "system", Content: "You are a bartender."},
+		{Role: "user", Content: "Good evening!"},
+		{Role: "assistant", Content: "What can I get you?"},
+		{Role: "user", Content: "A whiskey, please."},
+	}, cReqs[1].Messages)
+}
+
+func TestOpenAIResponseStream(t *testing.T) {
+	c := newConversation(t, func(cfg *config.Config) {
+		cfg.OpenAI.Stream = true
+	})
+
+	c.openai.QueueCompletions(openaitest.Completion("Coming right up, partner."))
+	require.NoError(t, c.ask(t, "A beer, please."))
+
+	sent := c.rocket.Sent()
+	require.Len(t, sent, 1, "the placeholder should be edited")
+	assert.Equal(t, "@alice Coming right up, partner.", sent[0].Text)
+	assert.True(t, sent[0].Edited)
+}
+
+func TestOpenAIResponseModeration(t *testing.T) {
+	c := newConversation(t, func(cfg *config.Config) {
+		cfg.OpenAI.InputModeration = true
+		cfg.OpenAI.OutputModeration = true
+	})
+
+	// Flagged questions are not sent to the model.
+	c.openai.QueueModerations(openaitest.Moderation("violence"))
+	require.NoError(t, c.ask(t, "Something violent."))
+	assert.Empty(t, c.openai.CompletionRequests())
+	require.Len(t, c.answers(), 1)
+	assert.Contains(t, c.answers()[0], "REASON: Violence")
+
+	// Flagged answers are marked, and left out of the history with their question.
+	c.openai.QueueModerations(openaitest.Moderation(), openaitest.Moderation("hate"))
+	c.openai.QueueCompletions(openaitest.Completion("Something hateful."))
+	require.NoError(t, c.ask(t, "Tell me a joke."))
+	require.Len(t, c.answers(), 2)
+	assert.Equal(t, "@alice :triangular_flag_on_post: (output flagged: Hate) :triangular_flag_on_post:Something hateful.", c.answers()[1])
+	assert.Empty(t, c.bot.History.AsOpenAIMessages("alice"))
+
+	// Without a valid moderation, nothing is sent to the model.
+	c.openai.QueueModerations(openaitest.Response{Body: map[string]interface{}{}})
+	assert.Error(t, c.ask(t, "Hello"))
+	c.openai.QueueModerations(openaitest.ServerError(), openaitest.ServerError(), openaitest.ServerError())
+	assert.Error(t, c.ask(t, "Hello"))
+	assert.Len(t, c.openai.CompletionRequests(), 1)
+}
+
+func TestOpenAIResponseErrors(t *testing.T) {
+	c := newConversation(t, nil)
+
+	// The history is cleared if it does not fit in the context window.
+	require.NoError(t, c.ask(t, "Hello"))
+	c.openai.QueueCompletions(openaitest.ContextLengthExceeded())
+	err := c.ask(t, "A long story")
+	assert.True(t, errors.Is(err, &openai.ErrorContextLengthExceeded{}), err)
+	assert.Empty(t, c.bot.History.AsOpenAIMessages("alice"))
+
+	// Rate limits and server errors are retried.
+	c.openai.QueueCompletions(openaitest.RateLimited(0), openaitest.ServerError(), openaitest.Completion("Finally."))
+	require.NoError(t, c.ask(t, "Are you there?"))
+	assert.Equal(t, "@alice Finally.", c.answers()[len(c.answers())-1])
+	assert.Len(t, c.openai.CompletionRequests(), 5)
+
+	c.openai.QueueCompletions(openaitest.ServerError(), openaitest.ServerError(), openaitest.ServerError())
+	var serverErr *openai.ErrorServer
+	assert.ErrorAs(t, c.ask(t, "Hello?"), &serverErr)
+
+	// Slow responses time out.
+	c.bot.OpenAI.MaxRetries = 0
+	c.bot.OpenAI.RequestTimeout = 50 * time.Millisecond
+	slow := openaitest.Completion("Too late.")
+	slow.Delay = time.Second
+	c.openai.QueueCompletions(slow)
+	var timeoutErr *openai.ErrorTimeout
+	assert.ErrorAs(t, c.ask(t, "Quick!"), &timeoutErr)
+
+	// Authentication errors are not retried.
+	c.bot.OpenAI.ApiToken = "wrong"
+	requests := len(c.openai.CompletionRequests())
+	var authErr *openai.ErrorAuth
+	assert.ErrorAs(t, c.ask(t, "Hello"), &authErr)
+	assert.Len(t, c.openai.Requests(openaitest.CompletionPath), requests+1)
+}
+
+func TestOpenAIResponseLocale(t *testing.T) {
+	c := newConversation(t, func(cfg *config.Config) {
+		cfg.Locale = "hu"
+		cfg.OpenAI.InputModeration = true
+	})
+
+	c.openai.QueueModerations(openaitest.Moderation("violence"))
+	require.NoError(t, c.ask(t, "Something violent."))
+	c.rocket.Post(rockettest.Message{RoomID: "d1", UserID: "alice-id", UserName: "alice", Text: "!reset"})
+	msg, err := c.bot.Rocket.GetNewMessage()
+	require.NoError(t, err)
+	require.NoError(t, c.bot.Handle(context.Background(), msg))
+	require.Len(t, c.answers(), 2)
+	assert.Contains(t, c.answers()[0], "INDOK: Violence")
+	assert.Equal(t, "@alice Elfelejtettem, amiről beszélgettünk.", c.answers()[1])
+
+	// The errors of the command arguments are translated too.
+	c.bot.Admins = []string{"alice"}
+	c.bot.Usage = NewMemoryUsageStore()
+	for _, text := range []string{"!summarize since yesterday", "!usage planet"} {
+		c.rocket.Post(rockettest.Message{RoomID: "d1", UserID: "alice-id", UserName: "alice", Text: text})
+		msg, err := c.bot.Rocket.GetNewMessage()
+		require.NoError(t, err)
+		require.NoError(t, c.bot.Handle(context.Background(), msg))
+	}
+	require.Len(t, c.answers(), 4)
+	assert.Equal(t, "@alice Érvénytelen időszak: yesterday. Használat: !summarize [üzenetek száma|since 2h]", c.answers()[2])
+	assert.Equal(t, "@alice Ismeretlen csoportosítás: planet. Ezek közül választhatsz: user, room, day, model.", c.answers()[3])
+}
+
+func TestOpenAIResponseModerationServer(t *testing.T) {
+	moderation := openaitest.NewServer()
+	defer moderation.Close()
+	c := newConversation(t, func(cfg *config.Config) {
+		cfg.OpenAI.InputModeration = true
+		cfg.Moderation.BaseURL = moderation.URL()
+		cfg.Moderation.ApiToken = openaitest.ApiToken
+	})
+
+	require.NoError(t, c.ask(t, "Hello"))
+	assert.Equal(t, []string{"Hello"}, moderation.ModerationInputs())
+	assert.Empty(t, c.openai.ModerationInputs(), "the server of the chat provider does not see the moderation requests")
+
+	// Without a moderation server, nothing is sent to a provider that has none.
+	c.bot.Moderator = nil
+	assert.Error(t, c.ask(t, "Hello again"))
+	assert.Len(t, c.openai.CompletionRequests(), 1)
+}
+
+func TestOpenAIResponseEstimatedUsage(t *testing.T) {
+	c := newConversation(t, nil)
+	c.bot.Usage = NewMemoryUsageStore()
+
+	unreported := openaitest.Completion("What can I get you?")
+	cresp := unreported.Body.(openai.CompletionResponse)
+	cresp.Usage = openai.Usage{}
+	unreported.Body = cresp
+	c.openai.QueueCompletions(openaitest.Completion("Hello!"), unreported)
+	require.NoError(t, c.ask(t, "Hi"))
+	require.NoError(t, c.ask(t, "Good evening!"))
+
+	records, err := c.bot.Usage.List(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, 10, records[0].PromptTokens)
+	assert.False(t, records[0].Estimated)
+	// The same estimate is counted in the quotas and stored in the usage records.
+	assert.True(t, records[1].Estimated)
+	assert.Greater(t, records[1].PromptTokens, 0)
+	assert.Greater(t, records[1].CompletionTokens, 0)
+	used, err := c.bot.Limits.Store.Get(monthKey(time.Now().UTC()))
+	require.NoError(t, err)
+	assert.Equal(t, 15+records[1].PromptTokens+records[1].CompletionTokens, used)
+}
+
+func TestOpenAIResponseMaxToolCalls(t *testing.T) {
+	c := newConversation(t, func(cfg *config.Config) {
+		cfg.OpenAI.Tools = []string{"get_message"}
+		cfg.OpenAI.MaxToolCalls = 1
+	})
+
+	call := openaitest.Completion("")
+	cresp := call.Body.(openai.CompletionResponse)
+	cresp.Choices[0].FinishReason = "tool_calls"
+	cresp.Choices[0].Message.ToolCalls = []openai.ToolCall{{
+		ID:       "call_1",
+		Type:     "function",
+		Function: openai.FunctionCall{Name: "get_message", Arguments: `{"message_id": "unknown"}`},
+	}}
+	call.Body = cresp
+	c.openai.QueueCompletions(call, openaitest.Completion("I cannot find it."))
+	require.NoError(t, c.ask(t, "What did bob say?"))
+	assert.Equal(t, []string{"@alice I cannot find it."}, c.answers())
+
+	// The final answer is forced without dropping the tools, because the messages contain a call of one.
+	cReqs := c.openai.CompletionRequests()
+	require.Len(t, cReqs, 2)
+	assert.Equal(t, "", cReqs[0].ToolChoice)
+	assert.Equal(t, "none", cReqs[1].ToolChoice)
+	assert.Len(t, cReqs[1].Tools, 1)
+	assert.Equal(t, "tool", cReqs[1].Messages[len(cReqs[1].Messages)-1].Role)
+}
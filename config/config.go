@@ -8,31 +8,130 @@ import (
 )
 
 type Config struct {
-	LogLevel   string `yaml:"LogLevel"`
+	LogLevel string            `yaml:"LogLevel"`
+	Workers  int               `yaml:"Workers"`
+	Personas map[string]string `yaml:"Personas"`
+	Admins   []string          `yaml:"Admins"` // The usernames of the users who can run the admin commands.
+	// Locale is the language of the messages of the bot, e.g. en, hu or de. Rooms can override it.
+	Locale string `yaml:"Locale"`
+	// Messages override the templates of the messages of the bot, keyed by locale and message name.
+	Messages map[string]map[string]string `yaml:"Messages"`
+	// Rooms override the settings of the OpenAI section in some rooms, keyed by room name or room id.
+	Rooms    map[string]RoomConfig `yaml:"Rooms"`
+	Database struct {
+		Path string `yaml:"Path"`
+	} `yaml:"Database"`
 	RocketChat struct {
-		UserId    string
+		UserId    string `yaml:"UserID"`
 		User      string `yaml:"User"`
 		Password  string `yaml:"Password"`
 		AuthToken string `yaml:"Authtoken"`
 		HostName  string `yaml:"HostName"`
 		SSL       bool   `yaml:"SSL"`
 		Port      uint16 `yaml:"Port"`
+		// Answer the messages in the main timeline of rooms in a new thread started on the question.
+		StartThreads bool `yaml:"StartThreads"`
 	} `yaml:"RocketChat"`
 	OpenAI struct {
-		HostName           string         `yaml:"HostName"`
-		ApiToken           string         `yaml:"ApiToken"`
-		CompletionEndpoint string         `yaml:"CompletionEndpoint"`
-		ModerationEndpoint string         `yaml:"ModerationEndpoint"`
-		Model              string         `yaml:"Model"`
-		HistorySize        int            `yaml:"HistorySize"`
-		HistoryMaxLength   int            `yaml:"HistoryMaxLength"`
-		MessageRetention   *time.Duration `yaml:"MessageRetention,omitempty"`
-		PrePrompt          string         `yaml:"PrePrompt"`
-		InputModeration    bool           `yaml:"InputModeration"`
-		OutputModeration   bool           `yaml:"OutputModeration"`
-		SendUserId         bool           `yaml:"SendUserId"`
-		ModelParams        ModelParams    `yaml:"ModelParams,omitempty"`
+		Provider              string         `yaml:"Provider"`
+		Scheme                string         `yaml:"Scheme"`
+		HostName              string         `yaml:"HostName"`
+		BaseURL               string         `yaml:"BaseURL"`
+		ApiToken              string         `yaml:"ApiToken"`
+		CompletionEndpoint    string         `yaml:"CompletionEndpoint"`
+		ModerationEndpoint    string         `yaml:"ModerationEndpoint"`
+		ModelsEndpoint        string         `yaml:"ModelsEndpoint"`
+		Transcribe            bool           `yaml:"Transcribe"`
+		TranscriptionEndpoint string         `yaml:"TranscriptionEndpoint"`
+		TranscriptionModel    string         `yaml:"TranscriptionModel"`
+		EchoTranscript        bool           `yaml:"EchoTranscript"`
+		ImageEndpoint         string         `yaml:"ImageEndpoint"`
+		ImageModel            string         `yaml:"ImageModel"`
+		ImageSize             string         `yaml:"ImageSize"`
+		AzureDeployment       string         `yaml:"AzureDeployment"`
+		AzureApiVersion       string         `yaml:"AzureApiVersion"`
+		Model                 string         `yaml:"Model"`
+		AllowedModels         []string       `yaml:"AllowedModels"`
+		ContextWindow         int            `yaml:"ContextWindow"`
+		HistorySize           int            `yaml:"HistorySize"`
+		HistoryMaxLength      int            `yaml:"HistoryMaxLength"`
+		HistoryStorage        string         `yaml:"HistoryStorage"`
+		MessageRetention      *time.Duration `yaml:"MessageRetention,omitempty"`
+		PrePrompt             string         `yaml:"PrePrompt"`
+		Summarize             bool           `yaml:"Summarize"`
+		SummarizeThreshold    int            `yaml:"SummarizeThreshold"`
+		SummarizeKeep         int            `yaml:"SummarizeKeep"`
+		SummarizeModel        string         `yaml:"SummarizeModel"`
+		SummaryPrompt         string         `yaml:"SummaryPrompt"`
+		InputModeration       bool           `yaml:"InputModeration"`
+		OutputModeration      bool           `yaml:"OutputModeration"`
+		SendUserId            bool           `yaml:"SendUserId"`
+		Stream                bool           `yaml:"Stream"`
+		Vision                bool           `yaml:"Vision"`
+		Tools                 []string       `yaml:"Tools"`
+		MaxToolCalls          int            `yaml:"MaxToolCalls"`
+		StreamEditInterval    time.Duration  `yaml:"StreamEditInterval"`
+		MaxRetries            int            `yaml:"MaxRetries"`
+		RetryDelay            time.Duration  `yaml:"RetryDelay"`
+		RequestTimeout        time.Duration  `yaml:"RequestTimeout"`
+		ModelParams           ModelParams    `yaml:"ModelParams,omitempty"`
 	} `yaml:"OpenAI"`
+	// Limits of the requests and the tokens, 0 means no limit. The token counters are kept in the database if any
+	// token quota is set.
+	Limits struct {
+		RequestsPerMinute int `yaml:"RequestsPerMinute"` // Per user.
+		UserDailyTokens   int `yaml:"UserDailyTokens"`
+		RoomDailyTokens   int `yaml:"RoomDailyTokens"`
+		MonthlyTokens     int `yaml:"MonthlyTokens"` // Of the whole bot.
+		ImageTokens       int `yaml:"ImageTokens"`   // The tokens a generated image counts as in the quotas.
+	} `yaml:"Limits"`
+	Usage struct {
+		// Record the usage of every completion, transcription and image in the database, for the !usage command
+		// and the usage subcommand.
+		Record  bool             `yaml:"Record"`
+		Pricing map[string]Price `yaml:"Pricing"` // By model name prefix.
+	} `yaml:"Usage"`
+	HTTP struct {
+		Listen  string `yaml:"Listen"` // The address of the HTTP server, e.g. :9090. Empty disables the server.
+		Metrics bool   `yaml:"Metrics"`
+		Health  bool   `yaml:"Health"`
+		// The bot is not ready if the Rocket.Chat server has not pinged it for MaxPingAge.
+		MaxPingAge time.Duration `yaml:"MaxPingAge"`
+		// The chat provider is checked at most once per ProbeInterval by the readiness probe.
+		ProbeInterval time.Duration `yaml:"ProbeInterval"`
+	} `yaml:"HTTP"`
+	// Moderation is the OpenAI-compatible server that checks the messages if InputModeration or OutputModeration is
+	// enabled. If BaseURL is empty, the server of the OpenAI section is used, which is only allowed with the openai
+	// provider, so the messages are never sent to OpenAI unexpectedly.
+	Moderation struct {
+		BaseURL  string `yaml:"BaseURL"`
+		ApiToken string `yaml:"ApiToken"`
+	} `yaml:"Moderation"`
+	Anthropic struct {
+		HostName string `yaml:"HostName"`
+		ApiKey   string `yaml:"ApiKey"`
+		Version  string `yaml:"Version"`
+	} `yaml:"Anthropic"`
+}
+
+// RoomConfig overrides the settings of the OpenAI section in a room. The fields that are not set fall back to the
+// global values.
+type RoomConfig struct {
+	Model            *string     `yaml:"Model,omitempty"`
+	PrePrompt        *string     `yaml:"PrePrompt,omitempty"`
+	HistorySize      *int        `yaml:"HistorySize,omitempty"`
+	InputModeration  *bool       `yaml:"InputModeration,omitempty"`
+	OutputModeration *bool       `yaml:"OutputModeration,omitempty"`
+	Vision           *bool       `yaml:"Vision,omitempty"`
+	Locale           *string     `yaml:"Locale,omitempty"`
+	ModelParams      ModelParams `yaml:"ModelParams,omitempty"`
+}
+
+// Price is the price of a model in USD per million tokens.
+type Price struct {
+	Prompt     float64 `yaml:"Prompt"`
+	Completion float64 `yaml:"Completion"`
+	Image      float64 `yaml:"Image"` // Per generated image.
 }
 
 type ModelParams struct {
@@ -43,7 +142,46 @@ type ModelParams struct {
 	MaxTokens        *int     `yaml:"MaxTokens,omitempty"`
 }
 
+// Room returns the overrides of the room with the given name or id. The id takes precedence.
+func (c *Config) Room(name string, id string) (RoomConfig, bool) {
+	if room, ok := c.Rooms[id]; ok {
+		return room, true
+	}
+	room, ok := c.Rooms[name]
+	return room, ok
+}
+
+// Merge returns p with the parameters that are set in override replaced.
+func (p ModelParams) Merge(override ModelParams) ModelParams {
+	if override.Temperature != nil {
+		p.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		p.TopP = override.TopP
+	}
+	if override.FrequencyPenalty != nil {
+		p.FrequencyPenalty = override.FrequencyPenalty
+	}
+	if override.PresencePenalty != nil {
+		p.PresencePenalty = override.PresencePenalty
+	}
+	if override.MaxTokens != nil {
+		p.MaxTokens = override.MaxTokens
+	}
+	return p
+}
+
 func NewConfig(path string) (*Config, error) {
+	config, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// load reads the configuration file at path. If some keys cannot be parsed, the configuration is returned with the
+// rest of the file, together with the *yaml.TypeError listing them.
+func load(path string) (*Config, error) {
 	file, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("cannot read configfile: %w", err)
@@ -54,10 +192,37 @@ func NewConfig(path string) (*Config, error) {
 
 	// Default values
 	config.RocketChat.SSL = true
+	config.Workers = 4
+	config.Locale = "en"
+	config.Database.Path = "bartender.db"
+	config.HTTP.Metrics = true
+	config.HTTP.Health = true
+	config.HTTP.MaxPingAge = 5 * time.Minute
+	config.HTTP.ProbeInterval = time.Minute
+	config.OpenAI.HistoryStorage = "memory"
+	config.OpenAI.Provider = "openai"
+	config.OpenAI.Scheme = "https"
+	config.Anthropic.HostName = "api.anthropic.com"
+	config.Anthropic.Version = "2023-06-01"
+	config.OpenAI.MaxRetries = 3
+	config.OpenAI.RetryDelay = time.Second
+	config.OpenAI.RequestTimeout = 2 * time.Minute
+	config.OpenAI.StreamEditInterval = time.Second
+	config.OpenAI.MaxToolCalls = 5
+	config.OpenAI.SummarizeKeep = 4
+	config.OpenAI.ModelsEndpoint = "v1/models"
+	config.OpenAI.TranscriptionEndpoint = "v1/audio/transcriptions"
+	config.OpenAI.TranscriptionModel = "whisper-1"
+	config.OpenAI.ImageEndpoint = "v1/images/generations"
+	config.OpenAI.ImageSize = "1024x1024"
+	config.Limits.ImageTokens = 8000
 
-	err = yaml.Unmarshal(file, &config)
-	if err != nil {
-		return nil, fmt.Errorf("cannot parse configfile %w", err)
+	// Unknown keys are rejected, so typos do not go unnoticed.
+	err = yaml.UnmarshalStrict(file, &config)
+	if _, ok := err.(*yaml.TypeError); ok {
+		return &config, fmt.Errorf("cannot parse configfile: %w", err)
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot parse configfile: %w", err)
 	}
 
 	return &config, nil
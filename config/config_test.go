@@ -0,0 +1,120 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestNewConfigDefault(t *testing.T) {
+	cfg, err := NewConfig("../config.yaml.default")
+	require.NoError(t, err)
+	assert.Equal(t, "bot-userid", cfg.RocketChat.UserId)
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestNewConfigStrict(t *testing.T) {
+	_, err := NewConfig(writeConfig(t, "OpenAI:\n  Modell: gpt-4o\n"))
+	assert.ErrorContains(t, err, "Modell")
+
+	_, err = NewConfig(writeConfig(t, "OpenAI:\n  RequestTimeout: 2 minutes\n"))
+	assert.Error(t, err, "invalid durations are rejected")
+}
+
+func TestValidate(t *testing.T) {
+	cfg, err := NewConfig(writeConfig(t, `
+LogLevel: verbose
+RocketChat:
+  HostName: chat.example.com
+OpenAI:
+  HostName: api.openai.com
+  HistorySize: -1
+  MessageRetention: 0s
+  ModelParams:
+    Temperature: 3
+    TopP: 0.5
+Rooms:
+  support:
+    Model: gpt-4
+    ModelParams:
+      MaxTokens: 0
+`))
+	require.NoError(t, err)
+
+	err = cfg.Validate()
+	var validationErr *ValidationError
+	require.True(t, errors.As(err, &validationErr), err)
+	assert.Equal(t, []string{
+		`LogLevel must be trace, debug, info, warning, error or fatal, not "verbose"`,
+		"OpenAI.ApiToken is required",
+		"OpenAI.HistorySize must be between 0 and 1000, not -1",
+		"OpenAI.MessageRetention must be a positive duration, e.g. 1m, not 0s",
+		"OpenAI.Model is required",
+		"OpenAI.ModelParams.Temperature must be between 0 and 2, not 3",
+		"RocketChat.User and RocketChat.Password, or RocketChat.Authtoken are required",
+		"Rooms.support.ModelParams.MaxTokens must be at least 1, not 0",
+	}, validationErr.Problems)
+
+	cfg, err = NewConfig(writeConfig(t, `
+RocketChat:
+  HostName: chat.example.com
+  User: bartender
+  Password: secret
+OpenAI:
+  Provider: anthropic
+  Model: claude-3-haiku-20240307
+Anthropic:
+  ApiKey: sk-ant
+`))
+	require.NoError(t, err)
+	assert.NoError(t, cfg.Validate(), "the OpenAI token is not needed without moderation")
+
+	// The messages are not moderated by OpenAI unless it is configured explicitly.
+	moderation := true
+	cfg.Rooms = map[string]RoomConfig{"random": {InputModeration: &moderation}}
+	assert.EqualError(t, cfg.Validate(), "invalid configuration:\n  Moderation.BaseURL is required for InputModeration and OutputModeration with the anthropic provider")
+	cfg.Moderation.BaseURL = "https://api.openai.com"
+	assert.NoError(t, cfg.Validate())
+
+	cfg.OpenAI.Provider = "azure"
+	cfg.OpenAI.HostName = "example.openai.azure.com"
+	cfg.OpenAI.ApiToken = "secret"
+	cfg.OpenAI.AzureDeployment = "gpt4o"
+	cfg.OpenAI.AzureApiVersion = "2024-02-01"
+	assert.NoError(t, cfg.Validate())
+	cfg.OpenAI.Transcribe = false
+	cfg.OpenAI.HistorySize = 6
+	cfg.OpenAI.Summarize = true
+	cfg.OpenAI.SummarizeKeep = 4
+	assert.NoError(t, cfg.Validate())
+	cfg.OpenAI.SummarizeThreshold = 8
+	assert.EqualError(t, cfg.Validate(), "invalid configuration:\n  OpenAI.SummarizeThreshold (8) must not be more than OpenAI.HistorySize (6)")
+	cfg.OpenAI.Summarize = false
+
+	cfg.OpenAI.Transcribe = true
+	assert.EqualError(t, cfg.Validate(), "invalid configuration:\n  OpenAI.Transcribe and OpenAI.ImageModel are not supported with the azure provider")
+}
+
+func TestCheck(t *testing.T) {
+	cfg, err := Check(writeConfig(t, "Workers: 0\nOpenAI:\n  Modell: gpt-4o\n  RequestTimeout: 2 minutes\n"))
+	require.NotNil(t, cfg, "the rest of the file is parsed")
+	var validationErr *ValidationError
+	require.True(t, errors.As(err, &validationErr))
+	assert.Equal(t, "line 3: field Modell not found", validationErr.Problems[0])
+	assert.Contains(t, validationErr.Problems[1], "line 4: cannot unmarshal !!str `2 minutes`")
+	assert.Contains(t, validationErr.Problems, "Workers must be at least 1, not 0")
+
+	cfg, err = Check(writeConfig(t, "Workers: [1\n"))
+	assert.Nil(t, cfg)
+	assert.ErrorContains(t, err, "cannot parse configfile")
+}
@@ -0,0 +1,306 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// MaxHistorySize is the largest HistorySize accepted. A longer history would not fit in the context window of any
+// model anyway.
+const MaxHistorySize = 1000
+
+// ValidationError lists every problem found in a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// problems collects the problems of a configuration.
+type problems []string
+
+func (p *problems) add(format string, args ...interface{}) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+// Validate checks the configuration. It returns a *ValidationError listing all the problems, or nil if there are
+// none. It does not connect to anything.
+func (c *Config) Validate() error {
+	var p problems
+
+	switch c.LogLevel {
+	case "", "trace", "debug", "info", "warning", "error", "fatal":
+	default:
+		p.add("LogLevel must be trace, debug, info, warning, error or fatal, not %q", c.LogLevel)
+	}
+	if c.Workers < 1 {
+		p.add("Workers must be at least 1, not %d", c.Workers)
+	}
+	if c.Locale == "" {
+		p.add("Locale is required")
+	}
+	needsDatabase := c.OpenAI.HistoryStorage == "database" || c.Usage.Record ||
+		c.Limits.UserDailyTokens > 0 || c.Limits.RoomDailyTokens > 0 || c.Limits.MonthlyTokens > 0
+	if needsDatabase && c.Database.Path == "" {
+		p.add("Database.Path is required to keep the history, the usage or the token counters in the database")
+	}
+
+	c.validateRocketChat(&p)
+	c.validateOpenAI(&p)
+
+	if c.Limits.RequestsPerMinute < 0 || c.Limits.UserDailyTokens < 0 || c.Limits.RoomDailyTokens < 0 || c.Limits.MonthlyTokens < 0 ||
+		c.Limits.ImageTokens < 0 {
+		p.add("Limits must not be negative")
+	}
+	for model, price := range c.Usage.Pricing {
+		if price.Prompt < 0 || price.Completion < 0 || price.Image < 0 {
+			p.add("Usage.Pricing.%s must not be negative", model)
+		}
+	}
+	if c.HTTP.Listen != "" {
+		positiveDuration(&p, "HTTP.MaxPingAge", c.HTTP.MaxPingAge)
+		positiveDuration(&p, "HTTP.ProbeInterval", c.HTTP.ProbeInterval)
+	}
+
+	for name, room := range c.Rooms {
+		if room.Model != nil {
+			if *room.Model == "" {
+				p.add("Rooms.%s.Model must not be empty", name)
+			} else if len(c.OpenAI.AllowedModels) > 0 && !contains(c.OpenAI.AllowedModels, *room.Model) {
+				p.add("Rooms.%s.Model %s is not in OpenAI.AllowedModels", name, *room.Model)
+			}
+		}
+		if room.HistorySize != nil {
+			validateHistorySize(&p, "Rooms."+name+".HistorySize", *room.HistorySize)
+		}
+		if room.Locale != nil && *room.Locale == "" {
+			p.add("Rooms.%s.Locale must not be empty", name)
+		}
+		room.ModelParams.validate(&p, "Rooms."+name+".ModelParams")
+	}
+
+	if len(p) > 0 {
+		// The maps are iterated in random order, but the report should be the same every time.
+		sort.Strings(p)
+		return &ValidationError{Problems: p}
+	}
+	return nil
+}
+
+// Check loads the configuration file at path and validates it. The keys that cannot be parsed (e.g. unknown keys or
+// invalid durations) and the problems found by Validate are returned together in a *ValidationError, with the
+// configuration parsed from the rest of the file. Any other error means the file cannot be read or is not YAML at
+// all; the configuration is nil then.
+func Check(path string) (*Config, error) {
+	c, err := load(path)
+	var p problems
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		for _, problem := range typeErr.Errors {
+			// The sections are anonymous structs, their types only make the message unreadable.
+			if i := strings.Index(problem, " not found in type "); i >= 0 {
+				problem = problem[:i+len(" not found")]
+			}
+			p = append(p, problem)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var validationErr *ValidationError
+	if errors.As(c.Validate(), &validationErr) {
+		p = append(p, validationErr.Problems...)
+	}
+	if len(p) > 0 {
+		return c, &ValidationError{Problems: p}
+	}
+	return c, nil
+}
+
+func (c *Config) validateRocketChat(p *problems) {
+	if c.RocketChat.HostName == "" {
+		p.add("RocketChat.HostName is required")
+	}
+	if c.RocketChat.AuthToken == "" && (c.RocketChat.User == "" || c.RocketChat.Password == "") {
+		p.add("RocketChat.User and RocketChat.Password, or RocketChat.Authtoken are required")
+	}
+	if c.RocketChat.AuthToken != "" && c.RocketChat.User == "" && c.RocketChat.UserId == "" {
+		p.add("RocketChat.UserID or RocketChat.User is required with RocketChat.Authtoken")
+	}
+}
+
+func (c *Config) validateOpenAI(p *problems) {
+	o := c.OpenAI
+	switch o.Provider {
+	case "openai", "azure", "":
+		c.validateOpenAIServer(p)
+		if o.Provider == "azure" && (o.AzureDeployment == "" || o.AzureApiVersion == "") {
+			p.add("OpenAI.AzureDeployment and OpenAI.AzureApiVersion are required with the azure provider")
+		}
+		if o.Provider == "azure" && (o.Transcribe || o.ImageModel != "") {
+			// They would need deployments of their own, the deployment of the chat model cannot serve them.
+			p.add("OpenAI.Transcribe and OpenAI.ImageModel are not supported with the azure provider")
+		}
+	case "anthropic":
+		if c.Anthropic.HostName == "" {
+			p.add("Anthropic.HostName is required with the anthropic provider")
+		}
+		if c.Anthropic.ApiKey == "" {
+			p.add("Anthropic.ApiKey is required with the anthropic provider")
+		}
+		if o.Transcribe || o.ImageModel != "" {
+			// Transcription and images are always served by OpenAI.
+			c.validateOpenAIServer(p)
+		}
+	default:
+		p.add("OpenAI.Provider must be openai, azure or anthropic, not %q", o.Provider)
+	}
+
+	if c.moderates() {
+		if c.Moderation.BaseURL != "" {
+			u, err := url.Parse(c.Moderation.BaseURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				p.add("Moderation.BaseURL must be an http or https URL, not %q", c.Moderation.BaseURL)
+			}
+		} else if o.Provider != "openai" && o.Provider != "" {
+			p.add("Moderation.BaseURL is required for InputModeration and OutputModeration with the %s provider", o.Provider)
+		}
+	}
+
+	if o.Model == "" {
+		p.add("OpenAI.Model is required")
+	} else if len(o.AllowedModels) > 0 && !contains(o.AllowedModels, o.Model) {
+		p.add("OpenAI.Model %s is not in OpenAI.AllowedModels", o.Model)
+	}
+	if o.Transcribe && o.TranscriptionModel == "" {
+		p.add("OpenAI.TranscriptionModel is required if OpenAI.Transcribe is enabled")
+	}
+
+	validateHistorySize(p, "OpenAI.HistorySize", o.HistorySize)
+	switch o.HistoryStorage {
+	case "memory", "database", "":
+	default:
+		p.add("OpenAI.HistoryStorage must be memory or database, not %q", o.HistoryStorage)
+	}
+	if o.HistoryMaxLength < 0 {
+		p.add("OpenAI.HistoryMaxLength must not be negative")
+	}
+	if o.ContextWindow < 0 {
+		p.add("OpenAI.ContextWindow must not be negative")
+	}
+	if o.MessageRetention != nil {
+		positiveDuration(p, "OpenAI.MessageRetention", *o.MessageRetention)
+	}
+	if o.Summarize {
+		threshold := o.SummarizeThreshold
+		if threshold == 0 {
+			threshold = o.HistorySize
+		}
+		if o.SummarizeThreshold < 0 || o.SummarizeKeep < 0 {
+			p.add("OpenAI.SummarizeThreshold and OpenAI.SummarizeKeep must not be negative")
+		} else if o.SummarizeThreshold > o.HistorySize {
+			// The history is never longer than its size, so the summary would never be made.
+			p.add("OpenAI.SummarizeThreshold (%d) must not be more than OpenAI.HistorySize (%d)", o.SummarizeThreshold, o.HistorySize)
+		} else if o.SummarizeKeep >= threshold {
+			p.add("OpenAI.SummarizeKeep (%d) must be less than the summarize threshold (%d)", o.SummarizeKeep, threshold)
+		}
+	}
+	if o.MaxToolCalls < 0 {
+		p.add("OpenAI.MaxToolCalls must not be negative")
+	}
+	if o.MaxRetries < 0 {
+		p.add("OpenAI.MaxRetries must not be negative")
+	}
+	if o.RetryDelay < 0 {
+		p.add("OpenAI.RetryDelay must not be negative")
+	}
+	if o.RequestTimeout < 0 {
+		p.add("OpenAI.RequestTimeout must not be negative")
+	}
+	if o.StreamEditInterval < 0 {
+		p.add("OpenAI.StreamEditInterval must not be negative")
+	}
+	o.ModelParams.validate(p, "OpenAI.ModelParams")
+}
+
+// moderates tells whether any message is checked by the moderation endpoint, in any room.
+func (c *Config) moderates() bool {
+	if c.OpenAI.InputModeration || c.OpenAI.OutputModeration {
+		return true
+	}
+	for _, room := range c.Rooms {
+		if room.InputModeration != nil && *room.InputModeration || room.OutputModeration != nil && *room.OutputModeration {
+			return true
+		}
+	}
+	return false
+}
+
+// validateOpenAIServer checks the settings needed to reach the OpenAI API or a compatible server.
+func (c *Config) validateOpenAIServer(p *problems) {
+	o := c.OpenAI
+	if o.BaseURL != "" {
+		u, err := url.Parse(o.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			p.add("OpenAI.BaseURL must be an http or https URL, not %q", o.BaseURL)
+		}
+	} else {
+		if o.HostName == "" {
+			p.add("OpenAI.HostName or OpenAI.BaseURL is required")
+		}
+		if o.Scheme != "http" && o.Scheme != "https" {
+			p.add("OpenAI.Scheme must be http or https, not %q", o.Scheme)
+		}
+	}
+	// Local compatible servers often need no token, but OpenAI and Azure always do.
+	if o.ApiToken == "" && (o.Provider == "azure" || o.BaseURL == "" && o.HostName == "api.openai.com") {
+		p.add("OpenAI.ApiToken is required")
+	}
+}
+
+func (m ModelParams) validate(p *problems, prefix string) {
+	if m.Temperature != nil && (*m.Temperature < 0 || *m.Temperature > 2) {
+		p.add("%s.Temperature must be between 0 and 2, not %g", prefix, *m.Temperature)
+	}
+	if m.TopP != nil && (*m.TopP < 0 || *m.TopP > 1) {
+		p.add("%s.TopP must be between 0 and 1, not %g", prefix, *m.TopP)
+	}
+	if m.FrequencyPenalty != nil && (*m.FrequencyPenalty < -2 || *m.FrequencyPenalty > 2) {
+		p.add("%s.FrequencyPenalty must be between -2 and 2, not %g", prefix, *m.FrequencyPenalty)
+	}
+	if m.PresencePenalty != nil && (*m.PresencePenalty < -2 || *m.PresencePenalty > 2) {
+		p.add("%s.PresencePenalty must be between -2 and 2, not %g", prefix, *m.PresencePenalty)
+	}
+	if m.MaxTokens != nil && *m.MaxTokens < 1 {
+		p.add("%s.MaxTokens must be at least 1, not %d", prefix, *m.MaxTokens)
+	}
+}
+
+func validateHistorySize(p *problems, name string, size int) {
+	if size < 0 || size > MaxHistorySize {
+		p.add("%s must be between 0 and %d, not %d", name, MaxHistorySize, size)
+	}
+}
+
+func positiveDuration(p *problems, name string, d time.Duration) {
+	if d <= 0 {
+		p.add("%s must be a positive duration, e.g. 1m, not %s", name, d)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	databases      = make(map[string]*bolt.DB)
+	databasesMutex sync.Mutex
+)
+
+// openDatabase opens the bolt database at path. Bolt locks the file, so every feature that keeps persistent data
+// shares the same handle.
+func openDatabase(path string) (*bolt.DB, error) {
+	databasesMutex.Lock()
+	defer databasesMutex.Unlock()
+
+	if db, ok := databases[path]; ok {
+		return db, nil
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open database %s: %w", path, err)
+	}
+	databases[path] = db
+	return db, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import "sync"
+
+// Dispatcher runs jobs on a bounded number of goroutines. Jobs submitted with the same key are run one after the
+// other in submission order, jobs with different keys run concurrently.
+type Dispatcher struct {
+	slots  chan struct{}
+	mutex  sync.Mutex
+	queues map[string][]func()
+	wg     sync.WaitGroup
+}
+
+func NewDispatcher(workers int) *Dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Dispatcher{
+		slots:  make(chan struct{}, workers),
+		queues: make(map[string][]func()),
+	}
+}
+
+// Submit queues job behind the other jobs with the same key. It never blocks.
+func (d *Dispatcher) Submit(key string, job func()) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.wg.Add(1)
+	if queue, ok := d.queues[key]; ok {
+		// A goroutine is already draining this key, it will pick the job up.
+		d.queues[key] = append(queue, job)
+		return
+	}
+	d.queues[key] = []func(){job}
+	go d.drain(key)
+}
+
+// Wait blocks until every submitted job has finished.
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) drain(key string) {
+	for {
+		d.mutex.Lock()
+		queue := d.queues[key]
+		if len(queue) == 0 {
+			delete(d.queues, key)
+			d.mutex.Unlock()
+			return
+		}
+		job := queue[0]
+		d.queues[key] = queue[1:]
+		d.mutex.Unlock()
+
+		d.slots <- struct{}{}
+		job()
+		<-d.slots
+		d.wg.Done()
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcherSerializesPerKey(t *testing.T) {
+	d := NewDispatcher(4)
+
+	var mutex sync.Mutex
+	var order []int
+	for i := 0; i < 10; i++ {
+		i := i
+		d.Submit("room1", func() {
+			time.Sleep(time.Millisecond)
+			mutex.Lock()
+			order = append(order, i)
+			mutex.Unlock()
+		})
+	}
+	d.Wait()
+
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, order)
+}
+
+func TestDispatcherRunsKeysConcurrently(t *testing.T) {
+	d := NewDispatcher(2)
+
+	// The slow job must not delay the job in the other room.
+	release := make(chan struct{})
+	d.Submit("slow", func() {
+		<-release
+	})
+
+	done := make(chan struct{})
+	d.Submit("fast", func() {
+		close(done)
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("job in another room was blocked by a slow job")
+	}
+	close(release)
+	d.Wait()
+}
+
+func TestDispatcherLimitsWorkers(t *testing.T) {
+	d := NewDispatcher(2)
+
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		d.Submit(key, func() {
+			mutex.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+		})
+	}
+	d.Wait()
+
+	assert.Equal(t, 2, maxRunning)
+}
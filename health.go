@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+)
+
+// Health answers the liveness and readiness probes of orchestrators.
+type Health struct {
+	Rocket     *rocket.RocketCon
+	MaxPingAge time.Duration // The bot is not ready if the server has not pinged it for longer.
+	provider   *probe
+}
+
+func NewHealth(rock *rocket.RocketCon, chat ChatProvider, maxPingAge time.Duration, probeInterval time.Duration) *Health {
+	return &Health{
+		Rocket:     rock,
+		MaxPingAge: maxPingAge,
+		provider:   &probe{check: chat.Ping, interval: probeInterval},
+	}
+}
+
+// Check returns the problems that make the bot unable to answer, keyed by the name of the failing component.
+func (h *Health) Check(ctx context.Context) map[string]error {
+	problems := make(map[string]error)
+
+	status := h.Rocket.Status()
+	switch {
+	case !status.Connected:
+		problems["rocketchat"] = fmt.Errorf("not connected")
+	case !status.LoggedIn:
+		problems["rocketchat"] = fmt.Errorf("not logged in")
+	case time.Since(status.LastPing) > h.MaxPingAge:
+		problems["rocketchat"] = fmt.Errorf("no ping since %s", status.LastPing.Format(time.RFC3339))
+	}
+
+	if err := h.provider.result(ctx); err != nil {
+		problems["provider"] = err
+	}
+	return problems
+}
+
+// ServeLive answers /healthz. The process is alive if it can answer.
+func (h *Health) ServeLive(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// ServeReady answers /readyz with 200 if the bot can answer messages, and with 503 and the problems otherwise.
+func (h *Health) ServeReady(w http.ResponseWriter, r *http.Request) {
+	problems := h.Check(r.Context())
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+
+	lines := make([]string, 0, len(problems))
+	for name, err := range problems {
+		lines = append(lines, fmt.Sprintf("%s: %s", name, err))
+	}
+	sort.Strings(lines)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintln(w, strings.Join(lines, "\n"))
+}
+
+// probe caches the result of a check for interval, so frequent probes do not flood the checked service.
+type probe struct {
+	check    func(ctx context.Context) error
+	interval time.Duration
+	mutex    sync.Mutex
+	checked  time.Time
+	err      error
+}
+
+func (p *probe) result(ctx context.Context) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.checked.IsZero() && time.Since(p.checked) < p.interval {
+		return p.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	p.err = p.check(ctx)
+	p.checked = time.Now()
+	return p.err
+}
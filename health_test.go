@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbe(t *testing.T) {
+	calls := 0
+	failure := errors.New("unreachable")
+	p := &probe{
+		check: func(ctx context.Context) error {
+			calls++
+			return failure
+		},
+		interval: time.Hour,
+	}
+
+	assert.Equal(t, failure, p.result(context.Background()))
+	assert.Equal(t, failure, p.result(context.Background()))
+	assert.Equal(t, 1, calls, "the result should be cached")
+
+	p.checked = time.Now().Add(-2 * time.Hour)
+	assert.Equal(t, failure, p.result(context.Background()))
+	assert.Equal(t, 2, calls, "the result should expire")
+}
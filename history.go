@@ -4,33 +4,45 @@ import (
 	"fmt"
 	"github.com/mimrock/rocketchat_openai_bot/config"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mimrock/rocketchat_openai_bot/openai"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type TimedMessage struct {
 	openai.Message
 	Timestamp time.Time
+	Summary   bool `json:",omitempty"` // The message condenses the older turns. It is kept at the front.
 }
 
 type History struct {
-	Messages   map[string][]TimedMessage
+	Store      HistoryStore
 	Size       int
 	MaxLength  int
 	Expiration time.Duration
+	// mutex makes the load-modify-save cycles of the methods atomic.
+	mutex sync.Mutex
 }
 
 func NewHistory() *History {
 	h := new(History)
-	h.Messages = make(map[string][]TimedMessage)
+	h.Store = NewMemoryHistoryStore()
 	return h
 }
 
-func NewHistoryFromConfig(cfg *config.Config) *History {
+func NewHistoryFromConfig(cfg *config.Config, store HistoryStore) *History {
 	h := new(History)
-	h.Messages = make(map[string][]TimedMessage)
+	h.Store = store
 	h.Size = cfg.OpenAI.HistorySize
+	// Keep enough messages for the rooms that use a longer history. They are cut to the size of the room when used.
+	for _, room := range cfg.Rooms {
+		if room.HistorySize != nil && *room.HistorySize > h.Size {
+			h.Size = *room.HistorySize
+		}
+	}
 	h.MaxLength = cfg.OpenAI.HistoryMaxLength
 	if cfg.OpenAI.MessageRetention != nil {
 		h.Expiration = *cfg.OpenAI.MessageRetention
@@ -41,66 +53,156 @@ func NewHistoryFromConfig(cfg *config.Config) *History {
 }
 
 func (h *History) GetAsString(place string) string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
 	var ret string
-	if messages, ok := h.Messages[place]; ok {
-		for _, m := range messages {
-			ret += fmt.Sprintf("\n%s", m.Content)
-		}
+	for _, m := range h.load(place, time.Now()) {
+		ret += fmt.Sprintf("\n%s", m.Content)
 	}
 	// @todo cut so it won't be longer than maxLength
 	return strings.TrimSpace(ret)
 }
 
 func (h *History) AsOpenAIMessages(place string) []openai.Message {
-	now := time.Now()
-	h.Messages[place] = h.clearExpired(place, now)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
 
-	if messages, ok := h.Messages[place]; ok {
-		openaiMessages := make([]openai.Message, len(messages))
-		for i, m := range messages {
-			openaiMessages[i] = m.Message
-		}
-		return openaiMessages
+	messages := h.load(place, time.Now())
+	openaiMessages := make([]openai.Message, len(messages))
+	for i, m := range messages {
+		openaiMessages[i] = m.Message
 	}
-	// @todo cut so it won't be longer than maxLength
-	return []openai.Message{}
+	return openaiMessages
 }
 
 func (h *History) Add(place string, message openai.Message) {
+	h.add(place, []openai.Message{message}, true)
+}
+
+// Append adds messages to the history of place without trimming it to Size, so the oldest ones can be summarized
+// before they are dropped. Trim must be called afterwards.
+func (h *History) Append(place string, messages ...openai.Message) {
+	h.add(place, messages, false)
+}
+
+// Trim removes the oldest messages of place, so at most Size are left.
+func (h *History) Trim(place string) {
+	h.add(place, nil, true)
+}
+
+func (h *History) add(place string, newMessages []openai.Message, trim bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
 	// Remove any expired messages
 	now := time.Now()
-	h.Messages[place] = h.clearExpired(place, now)
+	messages := h.load(place, now)
+
+	for _, message := range newMessages {
+		messages = append(messages, TimedMessage{
+			Message:   message,
+			Timestamp: now,
+		})
+	}
+	if trim {
+		messages = trimHistory(messages, h.Size)
+	}
+
+	err := h.Store.Save(place, messages)
+	if err != nil {
+		log.WithError(err).WithField("place", place).Error("Cannot save history.")
+	}
+}
 
-	timedMessage := TimedMessage{
-		Message:   message,
+// ReplaceWithSummary replaces the n oldest messages of place (including the previous summary) with summary.
+func (h *History) ReplaceWithSummary(place string, n int, summary openai.Message) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := time.Now()
+	messages := h.load(place, now)
+	if n > len(messages) {
+		n = len(messages)
+	}
+	messages = append([]TimedMessage{{
+		Message:   summary,
 		Timestamp: now,
+		Summary:   true,
+	}}, messages[n:]...)
+
+	err := h.Store.Save(place, messages)
+	if err != nil {
+		log.WithError(err).WithField("place", place).Error("Cannot save history.")
 	}
+}
 
-	if messages, ok := h.Messages[place]; ok {
-		messages = append(messages, timedMessage)
-		if len(messages) > h.Size {
-			messages = messages[len(messages)-h.Size:]
+func (h *History) Clear(place string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	err := h.Store.Delete(place)
+	if err != nil {
+		log.WithError(err).WithField("place", place).Error("Cannot clear history.")
+	}
+}
+
+// load returns the messages of place that are not expired yet. The expired ones are removed from the store.
+func (h *History) load(place string, now time.Time) []TimedMessage {
+	messages, err := h.Store.Load(place)
+	if err != nil {
+		log.WithError(err).WithField("place", place).Error("Cannot load history.")
+		return []TimedMessage{}
+	}
+
+	validMessages := clearExpired(messages, now, h.Expiration)
+	if len(validMessages) != len(messages) {
+		err = h.Store.Save(place, validMessages)
+		if err != nil {
+			log.WithError(err).WithField("place", place).Error("Cannot save history.")
 		}
-		h.Messages[place] = messages
-		return
 	}
-	h.Messages[place] = []TimedMessage{timedMessage}
+	return validMessages
 }
 
-func (h *History) Clear(place string) {
-	h.Messages[place] = []TimedMessage{}
+// trimHistory removes the oldest messages, so at most size are left. The summary is kept.
+func trimHistory(messages []TimedMessage, size int) []TimedMessage {
+	if len(messages) <= size {
+		return messages
+	}
+	if size > 0 && messages[0].Summary {
+		return append(messages[:1:1], messages[len(messages)-size+1:]...)
+	}
+	return messages[len(messages)-size:]
+}
+
+// dropOldest removes the oldest turns from history until fits returns true. A turn starts with a user message, so
+// the remaining history never begins with an orphaned answer of the assistant. A summary at the front is kept while
+// there are turns after it to drop, because it stands for the older ones.
+func dropOldest(history []openai.Message, fits func([]openai.Message) bool) []openai.Message {
+	var summary []openai.Message
+	if len(history) > 0 && isSummary(history[0]) {
+		summary, history = history[:1:1], history[1:]
+	}
+	for len(history) > 0 && !fits(append(summary, history...)) {
+		history = history[1:]
+		for len(history) > 0 && history[0].Role != "user" {
+			history = history[1:]
+		}
+	}
+	if len(summary) > 0 && fits(append(summary, history...)) {
+		return append(summary, history...)
+	}
+	return history
 }
 
 // clearExpired removes any expired messages from the history.
-func (h *History) clearExpired(place string, now time.Time) []TimedMessage {
-	if messages, ok := h.Messages[place]; ok {
-		var validMessages []TimedMessage
-		for _, message := range messages {
-			if now.Sub(message.Timestamp) <= h.Expiration {
-				validMessages = append(validMessages, message)
-			}
+func clearExpired(messages []TimedMessage, now time.Time, expiration time.Duration) []TimedMessage {
+	validMessages := []TimedMessage{}
+	for _, message := range messages {
+		if now.Sub(message.Timestamp) <= expiration {
+			validMessages = append(validMessages, message)
 		}
-		return validMessages
 	}
-	return []TimedMessage{}
+	return validMessages
 }
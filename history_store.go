@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// HistoryStore is where History keeps the messages of the conversations. A place is a conversation, for example
+// a room.
+type HistoryStore interface {
+	// Load returns the messages of place, oldest first. It returns an empty slice for unknown places.
+	Load(place string) ([]TimedMessage, error)
+	// Save replaces the messages of place.
+	Save(place string, messages []TimedMessage) error
+	// Delete removes every message of place.
+	Delete(place string) error
+}
+
+// MemoryHistoryStore keeps the history in memory. It is lost when the bot stops.
+type MemoryHistoryStore struct {
+	messages map[string][]TimedMessage
+	mutex    sync.RWMutex
+}
+
+func NewMemoryHistoryStore() *MemoryHistoryStore {
+	return &MemoryHistoryStore{
+		messages: make(map[string][]TimedMessage),
+	}
+}
+
+func (s *MemoryHistoryStore) Load(place string) ([]TimedMessage, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// Copy, so the caller can modify the result without affecting the store.
+	messages := make([]TimedMessage, len(s.messages[place]))
+	copy(messages, s.messages[place])
+	return messages, nil
+}
+
+func (s *MemoryHistoryStore) Save(place string, messages []TimedMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.messages[place] = append([]TimedMessage{}, messages...)
+	return nil
+}
+
+func (s *MemoryHistoryStore) Delete(place string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.messages, place)
+	return nil
+}
+
+var historyBucket = []byte("history")
+
+// BoltHistoryStore keeps the history in a bolt database file, so conversations survive restarts.
+type BoltHistoryStore struct {
+	db *bolt.DB
+}
+
+func NewBoltHistoryStore(db *bolt.DB) (*BoltHistoryStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(historyBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create history bucket: %w", err)
+	}
+	return &BoltHistoryStore{db: db}, nil
+}
+
+func (s *BoltHistoryStore) Load(place string) ([]TimedMessage, error) {
+	messages := []TimedMessage{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(historyBucket).Get([]byte(place))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &messages)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot load history: %w", err)
+	}
+	return messages, nil
+}
+
+func (s *BoltHistoryStore) Save(place string, messages []TimedMessage) error {
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return fmt.Errorf("cannot marshal history: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(historyBucket).Put([]byte(place), data)
+	})
+}
+
+func (s *BoltHistoryStore) Delete(place string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(historyBucket).Delete([]byte(place))
+	})
+}
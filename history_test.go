@@ -1,11 +1,13 @@
 package main
 
 import (
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/mimrock/rocketchat_openai_bot/openai"
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestHistory(t *testing.T) {
@@ -56,3 +58,67 @@ func TestHistory(t *testing.T) {
 	// message2 should be removed from the history because of size limit.
 	assert.Equal(t, "m3\nm4\nm5\nm6", history.GetAsString("chat1"))
 }
+
+func TestBoltHistoryStore(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "history.db"), 0600, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	store, err := NewBoltHistoryStore(db)
+	assert.NoError(t, err)
+
+	history := NewHistory()
+	history.Store = store
+	history.Expiration = time.Hour
+	history.Size = 2
+
+	history.Add("chat1", openai.Message{Role: "user", Content: "Hello"})
+	history.Add("chat1", openai.Message{Role: "assistant", Content: "Hi"})
+	history.Add("chat1", openai.Message{Role: "user", Content: "How are you?"})
+	history.Add("chat2", openai.Message{Role: "user", Content: "Other room"})
+
+	// A new History on the same database sees the same conversations, like after a restart.
+	restarted := NewHistory()
+	restarted.Store, err = NewBoltHistoryStore(db)
+	assert.NoError(t, err)
+	restarted.Expiration = time.Hour
+	restarted.Size = 2
+
+	assert.Equal(t, []openai.Message{
+		{Role: "assistant", Content: "Hi"},
+		{Role: "user", Content: "How are you?"},
+	}, restarted.AsOpenAIMessages("chat1"))
+	assert.Equal(t, "Other room", restarted.GetAsString("chat2"))
+
+	restarted.Clear("chat1")
+	assert.Equal(t, 0, len(history.AsOpenAIMessages("chat1")))
+	assert.Equal(t, "", history.GetAsString("unknown"))
+}
+
+func TestDropOldest(t *testing.T) {
+	history := []openai.Message{
+		{Role: "user", Content: "m1"},
+		{Role: "assistant", Content: "m2"},
+		{Role: "user", Content: "m3"},
+		{Role: "assistant", Content: "m4"},
+	}
+
+	// Whole turns are dropped, the remaining history starts with a user message.
+	fitsThree := func(h []openai.Message) bool { return len(h) <= 3 }
+	assert.Equal(t, history[2:], dropOldest(history, fitsThree))
+
+	fitsAll := func(h []openai.Message) bool { return true }
+	assert.Equal(t, history, dropOldest(history, fitsAll))
+
+	fitsNothing := func(h []openai.Message) bool { return false }
+	assert.Equal(t, 0, len(dropOldest(history, fitsNothing)))
+
+	// The summary and the history together exceed the budget: the turns after the summary are dropped first.
+	summary := openai.Message{Role: "system", Content: "Summary of the earlier conversation: m0"}
+	summarized := append([]openai.Message{summary}, history...)
+	want := append([]openai.Message{summary}, history[2:]...)
+	assert.Equal(t, want, dropOldest(summarized, fitsThree))
+	fitsOne := func(h []openai.Message) bool { return len(h) <= 1 }
+	assert.Equal(t, []openai.Message{summary}, dropOldest(summarized, fitsOne))
+	assert.Equal(t, 0, len(dropOldest(summarized, fitsNothing)))
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/metrics"
+)
+
+// newHTTPServer returns the server of the operational endpoints, listening on HTTP.Listen.
+func newHTTPServer(cfg *config.Config, health *Health) *http.Server {
+	mux := http.NewServeMux()
+	if cfg.HTTP.Metrics {
+		mux.Handle("/metrics", metrics.Handler())
+	}
+	if cfg.HTTP.Health {
+		mux.HandleFunc("/healthz", health.ServeLive)
+		mux.HandleFunc("/readyz", health.ServeReady)
+	}
+	return &http.Server{
+		Addr:    cfg.HTTP.Listen,
+		Handler: mux,
+	}
+}
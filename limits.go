@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Limits enforces the request rate of the users and the token quotas of the users, the rooms and the bot. A limit
+// of 0 means no limit. The days and months are in UTC.
+type Limits struct {
+	RequestsPerMinute int // Per user.
+	UserDailyTokens   int
+	RoomDailyTokens   int
+	MonthlyTokens     int // Of the whole bot.
+	ImageTokens       int // The tokens a generated image counts as.
+	Store             CounterStore
+	requests          map[string][]time.Time // The times of the requests of the last minute, by user id.
+	mutex             sync.Mutex
+	now               func() time.Time
+}
+
+// LimitError is returned when a limit is hit. The users are told with the limit_<kind> message.
+type LimitError struct {
+	Kind  string // monthly, room_daily, user_daily or rate.
+	Limit int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("the %s limit of %d is reached", e.Kind, e.Limit)
+}
+
+func NewLimits(store CounterStore) *Limits {
+	return &Limits{
+		Store:    store,
+		requests: make(map[string][]time.Time),
+		now:      time.Now,
+	}
+}
+
+func NewLimitsFromConfig(cfg *config.Config, store CounterStore) *Limits {
+	l := NewLimits(store)
+	l.RequestsPerMinute = cfg.Limits.RequestsPerMinute
+	l.UserDailyTokens = cfg.Limits.UserDailyTokens
+	l.RoomDailyTokens = cfg.Limits.RoomDailyTokens
+	l.MonthlyTokens = cfg.Limits.MonthlyTokens
+	l.ImageTokens = cfg.Limits.ImageTokens
+	return l
+}
+
+// Check returns a *LimitError if the user may not send a request to the model in the room now. Otherwise the
+// request is counted in the request rate of the user.
+func (l *Limits) Check(userId string, roomId string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now().UTC()
+	quotas := []struct {
+		kind  string
+		limit int
+		key   string
+	}{
+		{"monthly", l.MonthlyTokens, monthKey(now)},
+		{"room_daily", l.RoomDailyTokens, roomKey(roomId, now)},
+		{"user_daily", l.UserDailyTokens, userKey(userId, now)},
+	}
+	for _, quota := range quotas {
+		if quota.limit == 0 {
+			continue
+		}
+		used, err := l.Store.Get(quota.key)
+		if err != nil {
+			return fmt.Errorf("cannot get the used tokens: %w", err)
+		}
+		if used >= quota.limit {
+			return &LimitError{Kind: quota.kind, Limit: quota.limit}
+		}
+	}
+
+	if l.RequestsPerMinute > 0 {
+		// Keep only the requests of the last minute.
+		var recent []time.Time
+		for _, t := range l.requests[userId] {
+			if now.Sub(t) < time.Minute {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) >= l.RequestsPerMinute {
+			l.requests[userId] = recent
+			return &LimitError{Kind: "rate", Limit: l.RequestsPerMinute}
+		}
+		l.requests[userId] = append(recent, now)
+	}
+	return nil
+}
+
+// Record adds tokens used by the user in the room to the quotas.
+func (l *Limits) Record(userId string, roomId string, tokens int) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now().UTC()
+	for _, key := range []string{monthKey(now), roomKey(roomId, now), userKey(userId, now)} {
+		err := l.Store.Add(key, tokens)
+		if err != nil {
+			return fmt.Errorf("cannot record the used tokens: %w", err)
+		}
+	}
+	return nil
+}
+
+func monthKey(now time.Time) string {
+	return "month/" + now.Format("2006-01")
+}
+
+func roomKey(roomId string, now time.Time) string {
+	return "room/" + roomId + "/" + now.Format("2006-01-02")
+}
+
+func userKey(userId string, now time.Time) string {
+	return "user/" + userId + "/" + now.Format("2006-01-02")
+}
+
+// CounterStore keeps the counters of the quotas.
+type CounterStore interface {
+	// Get returns the value of the counter, 0 if it does not exist.
+	Get(key string) (int, error)
+	// Add adds n to the counter.
+	Add(key string, n int) error
+}
+
+// MemoryCounterStore keeps the counters in memory. They are lost when the bot stops.
+type MemoryCounterStore struct {
+	counters map[string]int
+	mutex    sync.Mutex
+}
+
+func NewMemoryCounterStore() *MemoryCounterStore {
+	return &MemoryCounterStore{
+		counters: make(map[string]int),
+	}
+}
+
+func (s *MemoryCounterStore) Get(key string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.counters[key], nil
+}
+
+func (s *MemoryCounterStore) Add(key string, n int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.counters[key] += n
+	return nil
+}
+
+var quotaBucket = []byte("quota")
+
+// BoltCounterStore keeps the counters in a bolt database file, so they survive restarts.
+type BoltCounterStore struct {
+	db *bolt.DB
+}
+
+func NewBoltCounterStore(db *bolt.DB) (*BoltCounterStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(quotaBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create quota bucket: %w", err)
+	}
+	return &BoltCounterStore{db: db}, nil
+}
+
+func (s *BoltCounterStore) Get(key string) (int, error) {
+	var n int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = counterValue(tx.Bucket(quotaBucket).Get([]byte(key)))
+		return err
+	})
+	return n, err
+}
+
+func (s *BoltCounterStore) Add(key string, n int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(quotaBucket)
+		value, err := counterValue(bucket.Get([]byte(key)))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), []byte(strconv.Itoa(value+n)))
+	})
+}
+
+func counterValue(data []byte) (int, error) {
+	if data == nil {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, fmt.Errorf("invalid counter: %w", err)
+	}
+	return n, nil
+}
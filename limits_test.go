@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestLimits(t *testing.T) {
+	now := time.Date(2023, 5, 31, 23, 0, 0, 0, time.UTC)
+	l := NewLimits(NewMemoryCounterStore())
+	l.now = func() time.Time { return now }
+	l.RequestsPerMinute = 2
+	l.UserDailyTokens = 100
+
+	assert.NoError(t, l.Check("alice", "general"))
+	assert.NoError(t, l.Check("alice", "general"))
+	assert.IsType(t, &LimitError{}, l.Check("alice", "general"))
+	assert.NoError(t, l.Check("bob", "general"), "the rate is per user")
+
+	now = now.Add(time.Minute)
+	assert.NoError(t, l.Check("alice", "general"))
+
+	assert.NoError(t, l.Record("alice", "general", 100))
+	now = now.Add(time.Minute)
+	assert.IsType(t, &LimitError{}, l.Check("alice", "general"))
+	assert.NoError(t, l.Check("bob", "general"), "the quota is per user")
+
+	// The next day.
+	now = now.Add(time.Hour)
+	assert.NoError(t, l.Check("alice", "general"))
+}
+
+func TestBoltCounterStore(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	store, err := NewBoltCounterStore(db)
+	assert.NoError(t, err)
+
+	n, err := store.Get("user/alice/2023-05-31")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	assert.NoError(t, store.Add("user/alice/2023-05-31", 30))
+	assert.NoError(t, store.Add("user/alice/2023-05-31", 12))
+	n, err = store.Get("user/alice/2023-05-31")
+	assert.NoError(t, err)
+	assert.Equal(t, 42, n)
+}
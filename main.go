@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"net/http"
 	"os"
 
+	"github.com/mimrock/rocketchat_openai_bot/anthropic"
 	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/metrics"
 	"github.com/mimrock/rocketchat_openai_bot/rocket"
 
 	log "github.com/sirupsen/logrus"
@@ -21,6 +26,12 @@ func main() {
 	}
 	log.WithField("configFile", configFile).Info("Bartender v0.3 starting up.")
 
+	// The subcommands load the configuration themselves: check-config reports the keys that cannot be parsed
+	// instead of failing on them.
+	if len(os.Args) > 1 {
+		os.Exit(runSubcommand(configFile, os.Args[1:]))
+	}
+
 	cfg, err := config.NewConfig(configFile)
 	if err != nil {
 		log.Fatal("Cannot load config:", err.Error())
@@ -28,13 +39,20 @@ func main() {
 
 	setLogLevel(cfg.LogLevel)
 
+	// Fail fast instead of at the first message. The check-config subcommand gives a readable report.
+	err = cfg.Validate()
+	var validationErr *config.ValidationError
+	if errors.As(err, &validationErr) {
+		log.WithField("problems", validationErr.Problems).Fatal("Invalid configuration.")
+	}
+
 	rock, err := rocket.NewConnectionFromConfig(cfg)
 
 	if err != nil {
 		log.Fatal("Cannot create new rocketchat connection:", err.Error())
 	}
 
-	log.WithField("userId", rock.UserId).
+	log.WithField("userId", rock.OwnUserId()).
 		WithField("port", rock.HostPort).
 		WithField("hostName", rock.HostName).
 		WithField("displayName", rock.DisplayName).
@@ -49,34 +67,222 @@ func main() {
 	//rock.UserDefaultStatus(rocket.STATUS_ONLINE)
 
 	oa := openai.NewFromConfig(cfg)
+	chat, err := newChatProvider(cfg, oa)
+	if err != nil {
+		log.Fatal("Cannot create chat provider:", err.Error())
+	}
+
+	historyStore, err := newHistoryStore(cfg)
+	if err != nil {
+		log.Fatal("Cannot open history storage:", err.Error())
+	}
+	hist := NewHistoryFromConfig(cfg, historyStore)
+
+	bot := NewBotFromConfig(cfg, rock, chat, oa, hist)
+	bot.Messages, err = NewMessages(cfg.Messages)
+	if err != nil {
+		log.Fatal("Cannot load the messages:", err.Error())
+	}
+	for _, problem := range checkMessages(cfg) {
+		log.Warn(problem)
+	}
+	counterStore, err := newCounterStore(cfg)
+	if err != nil {
+		log.Fatal("Cannot open quota storage:", err.Error())
+	}
+	bot.Limits = NewLimitsFromConfig(cfg, counterStore)
+	if cfg.Usage.Record {
+		db, err := openDatabase(cfg.Database.Path)
+		if err != nil {
+			log.Fatal("Cannot open usage storage:", err.Error())
+		}
+		bot.Usage, err = NewBoltUsageStore(db)
+		if err != nil {
+			log.Fatal("Cannot open usage storage:", err.Error())
+		}
+	}
+
+	if cfg.HTTP.Listen != "" {
+		health := NewHealth(rock, chat, cfg.HTTP.MaxPingAge, cfg.HTTP.ProbeInterval)
+		server := newHTTPServer(cfg, health)
+		go func() {
+			log.WithField("listen", cfg.HTTP.Listen).Info("Starting HTTP server.")
+			err := server.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.WithError(err).Error("HTTP server stopped.")
+			}
+		}()
+	}
+
+	serve(rock, bot, cfg.Workers)
+}
 
-	hist := NewHistoryFromConfig(cfg)
+// serve answers the messages addressed to the bot on workers goroutines, until the connection is closed for good.
+func serve(rock *rocket.RocketCon, bot *Bot, workers int) {
+	dispatcher := NewDispatcher(workers)
 
 	for {
 		// Wait for a new message to come in
 		msg, err := rock.GetNewMessage()
 
-		// If error, quit because that means the connection probably quit
+		// If error, quit because that means the connection has been closed for good. Dropped websockets are
+		// reconnected by the rocket package without returning an error here.
 		if err != nil {
 			log.WithError(err).Error("An error occured, stopping.")
 			break
 		}
 
+		metrics.MessagesReceived.WithLabelValues(metricsRoom(bot.Config, msg)).Inc()
+
 		// If begins with '@Username ' or is in private chat
 		// @todo robot must be pinged in a private room
 		if msg.AmIPinged || msg.IsDirect {
 			log.WithField("message", msg).Debug("Incoming message for the bot.")
-			err = OpenAIResponse(msg, oa, hist)
-			if err != nil {
-				log.WithError(err).Error("OpenAI request failed.")
-				_, err = msg.Reply(fmt.Sprintf("@%s :x: Sorry, something went wrong while processing your request. This could be due to a configuration issue, a problem with the OpenAI API, or a bug in the system. Please check your configuration settings or try again later. More details can be found in the logs. :x:", msg.UserName))
-				if err != nil {
-					log.WithError(err).Error("Cannot send reply about the error rocketchat.")
-				}
+			// Messages are processed concurrently, but the ones in the same room are kept in order, so the
+			// history of the room stays consistent.
+			dispatcher.Submit(msg.RoomId, func() {
+				handleMessage(msg, bot)
+			})
+		}
+	}
+	dispatcher.Wait()
+}
 
+// metricsRoom returns the room label of msg in the metrics. Only the rooms of the configuration are labelled by name,
+// so the number of series stays bounded: the direct messages are "direct" and the rest of the rooms are "other".
+func metricsRoom(cfg *config.Config, msg rocket.Message) string {
+	if cfg != nil {
+		if _, ok := cfg.Room(msg.RoomName, msg.RoomId); ok {
+			if msg.RoomName != "" {
+				return msg.RoomName
 			}
+			return msg.RoomId
+		}
+	}
+	if msg.IsDirect {
+		return "direct"
+	}
+	return "other"
+}
+
+func handleMessage(msg rocket.Message, bot *Bot) {
+	// The error is reported where the answer would have gone.
+	msg = bot.InThread(msg)
+	err := bot.Handle(context.Background(), msg)
+	if err != nil {
+		log.WithError(err).Error("Cannot handle message.")
+		_, err = msg.Reply(fmt.Sprintf("@%s %s", msg.UserName, bot.errorReply(msg, err)))
+		if err != nil {
+			log.WithError(err).Error("Cannot send reply about the error rocketchat.")
+		}
+	}
+}
+
+// errorReply tells the user what went wrong, and what they can do about it, in the locale of the room of msg.
+func (b *Bot) errorReply(msg rocket.Message, err error) string {
+	kind := errorKind(err)
+	if kind == "" {
+		return b.text(msg, "error", MessageData{Error: err.Error()})
+	}
+	return b.text(msg, "error_"+kind, MessageData{Kind: kind, Error: err.Error()})
+}
+
+// errorKind returns the kind of a typed API error, or an empty string if err is of no known kind.
+func errorKind(err error) string {
+	var (
+		contextErr *openai.ErrorContextLengthExceeded
+		rateErr    *openai.ErrorRateLimit
+		quotaErr   *openai.ErrorQuotaExceeded
+		authErr    *openai.ErrorAuth
+		modelErr   *openai.ErrorInvalidModel
+		policyErr  *openai.ErrorContentPolicy
+		timeoutErr *openai.ErrorTimeout
+		serverErr  *openai.ErrorServer
+	)
+	switch {
+	case errors.As(err, &contextErr):
+		return "context_length"
+	case errors.As(err, &rateErr):
+		return "rate_limit"
+	case errors.As(err, &quotaErr):
+		return "quota"
+	case errors.As(err, &authErr):
+		return "auth"
+	case errors.As(err, &modelErr):
+		return "model"
+	case errors.As(err, &policyErr):
+		return "content_policy"
+	case errors.As(err, &timeoutErr):
+		return "timeout"
+	case errors.As(err, &serverErr):
+		return "server"
+	}
+	return ""
+}
+
+func newHistoryStore(cfg *config.Config) (HistoryStore, error) {
+	switch cfg.OpenAI.HistoryStorage {
+	case "memory", "":
+		return NewMemoryHistoryStore(), nil
+	case "database":
+		db, err := openDatabase(cfg.Database.Path)
+		if err != nil {
+			return nil, err
+		}
+		return NewBoltHistoryStore(db)
+	default:
+		return nil, fmt.Errorf("unknown history storage: %s", cfg.OpenAI.HistoryStorage)
+	}
+}
+
+// newCounterStore returns the store of the token quotas. The counters are persisted if there is a quota, so a restart
+// does not reset them.
+func newCounterStore(cfg *config.Config) (CounterStore, error) {
+	if cfg.Limits.UserDailyTokens == 0 && cfg.Limits.RoomDailyTokens == 0 && cfg.Limits.MonthlyTokens == 0 {
+		return NewMemoryCounterStore(), nil
+	}
+	db, err := openDatabase(cfg.Database.Path)
+	if err != nil {
+		return nil, err
+	}
+	return NewBoltCounterStore(db)
+}
+
+// newChatProvider returns the provider that answers the completion requests. OpenAI-compatible servers and Azure
+// OpenAI are served by oa.
+func newChatProvider(cfg *config.Config, oa *openai.OpenAI) (ChatProvider, error) {
+	switch cfg.OpenAI.Provider {
+	case "openai", "azure", "":
+		return oa, nil
+	case "anthropic":
+		return anthropic.NewFromConfig(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown provider: %s", cfg.OpenAI.Provider)
+	}
+}
+
+// newModerator returns the client of the moderation endpoint: the server of the Moderation section if it is set, or
+// the OpenAI client with the openai provider. Azure and Anthropic have no compatible moderation endpoint, and the
+// messages must not go to OpenAI behind the back of the admins who chose them, so nil is returned for them.
+func newModerator(cfg *config.Config, oa *openai.OpenAI) Moderator {
+	if cfg.Moderation.BaseURL != "" {
+		return &openai.OpenAI{
+			BaseURL:            cfg.Moderation.BaseURL,
+			ApiToken:           cfg.Moderation.ApiToken,
+			ModerationEndpoint: cfg.OpenAI.ModerationEndpoint,
+			ModelsEndpoint:     cfg.OpenAI.ModelsEndpoint,
+			MaxRetries:         cfg.OpenAI.MaxRetries,
+			RetryDelay:         cfg.OpenAI.RetryDelay,
+			RequestTimeout:     cfg.OpenAI.RequestTimeout,
+		}
+	}
+	switch cfg.OpenAI.Provider {
+	case "openai", "":
+		if oa != nil {
+			return oa
 		}
 	}
+	return nil
 }
 
 func setLogLevel(logLevel string) {
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+	"github.com/mimrock/rocketchat_openai_bot/rocket/rockettest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echo is a ChatProvider that repeats the last message of the requests.
+type echo struct {
+	mutex    sync.Mutex
+	requests int
+}
+
+func (e *echo) Completion(ctx context.Context, cReq *openai.CompletionRequest) (*openai.CompletionResponse, error) {
+	e.mutex.Lock()
+	e.requests++
+	e.mutex.Unlock()
+	return &openai.CompletionResponse{Choices: []openai.Choice{{
+		Message: openai.Message{Role: "assistant", Content: "You said: " + cReq.Messages[len(cReq.Messages)-1].Content},
+	}}}, nil
+}
+
+func (e *echo) CompletionStream(ctx context.Context, cReq *openai.CompletionRequest, onDelta func(string)) (*openai.CompletionResponse, error) {
+	return e.Completion(ctx, cReq)
+}
+
+func (e *echo) Ping(ctx context.Context) error {
+	return nil
+}
+
+func TestServe(t *testing.T) {
+	server := rockettest.NewServer(
+		rockettest.User{ID: "bot-id", UserName: "bartender", Password: "secret"},
+		rockettest.Room{ID: "r1", Name: "general", Type: "c"},
+		rockettest.Room{ID: "d1", Name: "alice", Type: "d"},
+	)
+	defer server.Close()
+
+	cfg := server.Config()
+	cfg.OpenAI.Model = "gpt-3.5-turbo"
+	cfg.OpenAI.HistorySize = 6
+	rock, err := rocket.NewConnectionFromConfig(cfg)
+	require.NoError(t, err)
+	require.NoError(t, server.WaitSubscribed("r1"))
+	require.NoError(t, server.WaitSubscribed("d1"))
+
+	chat := &echo{}
+	bot := NewBotFromConfig(cfg, rock, chat, openai.NewFromConfig(cfg), NewHistoryFromConfig(cfg, NewMemoryHistoryStore()))
+	done := make(chan struct{})
+	go func() {
+		serve(rock, bot, 2)
+		close(done)
+	}()
+
+	// Only the messages addressed to the bot are answered.
+	server.Post(rockettest.Message{RoomID: "r1", UserID: "u2", UserName: "bob", Text: "hello everyone"})
+	server.Post(rockettest.Message{RoomID: "r1", UserID: "u1", UserName: "alice", Text: "@bartender hello"})
+	server.Post(rockettest.Message{RoomID: "d1", UserID: "u1", UserName: "alice", Text: "how are you?"})
+	sent, err := server.WaitSent(2)
+	require.NoError(t, err)
+
+	replies := map[string]string{}
+	for _, msg := range sent {
+		replies[msg.RoomID] = msg.Text
+	}
+	assert.Equal(t, map[string]string{
+		"r1": "@alice You said: hello",
+		"d1": "@alice You said: how are you?",
+	}, replies)
+
+	rock.Close()
+	<-done
+	assert.Equal(t, 2, chat.requests)
+	assert.Len(t, server.Sent(), 2)
+}
+
+func TestErrorReply(t *testing.T) {
+	locale := "de"
+	cfg := &config.Config{Locale: "en", Rooms: map[string]config.RoomConfig{"allgemein": {Locale: &locale}}}
+	b := NewBotFromConfig(cfg, nil, nil, &openai.OpenAI{}, NewHistory())
+	msg := rocket.Message{RoomName: "general", RoomId: "r1"}
+
+	rateErr := fmt.Errorf("cannot perform completion request: %w", openai.NewAPIError(429, openai.HTTPError{Code: "rate_limit_exceeded"}))
+	assert.Contains(t, b.errorReply(msg, rateErr), "too many requests")
+	assert.Contains(t, b.errorReply(msg, openai.NewAPIError(429, openai.HTTPError{Code: "insufficient_quota"})), "run out of credit")
+	assert.Contains(t, b.errorReply(msg, openai.NewAPIError(401, openai.HTTPError{Code: "invalid_api_key"})), "API token")
+	assert.Contains(t, b.errorReply(msg, &openai.ErrorTimeout{Err: context.DeadlineExceeded}), "did not answer in time")
+	assert.Contains(t, b.errorReply(msg, errors.New("disk full")), "Sorry, something went wrong")
+
+	// The reply is in the language of the room.
+	msg = rocket.Message{RoomName: "allgemein", RoomId: "r2"}
+	assert.Contains(t, b.errorReply(msg, rateErr), "zu viele Anfragen")
+}
+
+// failing is a ChatProvider that always fails.
+type failing struct{}
+
+func (failing) Completion(ctx context.Context, cReq *openai.CompletionRequest) (*openai.CompletionResponse, error) {
+	return nil, &openai.ErrorServer{}
+}
+
+func (f failing) CompletionStream(ctx context.Context, cReq *openai.CompletionRequest, onDelta func(string)) (*openai.CompletionResponse, error) {
+	return f.Completion(ctx, cReq)
+}
+
+func (failing) Ping(ctx context.Context) error {
+	return nil
+}
+
+func TestHandleMessageErrorInThread(t *testing.T) {
+	server := rockettest.NewServer(
+		rockettest.User{ID: "bot-id", UserName: "bartender", Password: "secret"},
+		rockettest.Room{ID: "r1", Name: "general", Type: "c"},
+	)
+	defer server.Close()
+
+	cfg := server.Config()
+	cfg.OpenAI.Model = "gpt-3.5-turbo"
+	rock, err := rocket.NewConnectionFromConfig(cfg)
+	require.NoError(t, err)
+	defer rock.Close()
+	require.NoError(t, server.WaitSubscribed("r1"))
+
+	bot := NewBotFromConfig(cfg, rock, failing{}, openai.NewFromConfig(cfg), NewHistoryFromConfig(cfg, NewMemoryHistoryStore()))
+	bot.StartThreads = true
+	posted := server.Post(rockettest.Message{RoomID: "r1", UserID: "u1", UserName: "alice", Text: "@bartender hello"})
+	msg, err := rock.GetNewMessage()
+	require.NoError(t, err)
+	handleMessage(msg, bot)
+
+	sent := server.Sent()
+	require.Len(t, sent, 1)
+	assert.Equal(t, posted.ID, sent[0].ThreadID, "the error is reported in the thread of the answer")
+	assert.Contains(t, sent[0].Text, "having problems")
+}
+
+func TestMetricsRoom(t *testing.T) {
+	cfg := &config.Config{Rooms: map[string]config.RoomConfig{"support": {}, "r9": {}}}
+	assert.Equal(t, "support", metricsRoom(cfg, rocket.Message{RoomName: "support", RoomId: "r1"}))
+	assert.Equal(t, "r9", metricsRoom(cfg, rocket.Message{RoomId: "r9"}))
+	assert.Equal(t, "direct", metricsRoom(cfg, rocket.Message{RoomName: "alice", RoomId: "d1", IsDirect: true}))
+	assert.Equal(t, "other", metricsRoom(cfg, rocket.Message{RoomName: "random", RoomId: "r2"}))
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+	"gopkg.in/yaml.v2"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultLocale is the locale used if none is configured, and for the messages a translation leaves out.
+const DefaultLocale = "en"
+
+// bundledLocales are the translations of the messages shipped with the bot, one file per locale.
+//
+//go:embed locales/*.yaml
+var bundledLocales embed.FS
+
+// MessageData are the fields the message templates can use. Each message uses only some of them; the fields are
+// described in locales/en.yaml.
+type MessageData struct {
+	User    string
+	Room    string
+	Prefix  string
+	Name    string
+	Model   string
+	Persona string
+	List    string
+	Reason  string
+	Kind    string
+	Error   string
+	Count   int
+	Days    int
+	Limit   int
+	Text    string
+}
+
+// Messages renders the messages of the bot from templates, in the locale of the room.
+type Messages struct {
+	templates map[string]map[string]*template.Template // By locale and message name.
+}
+
+// NewMessages parses the bundled translations, and the templates in overrides on top of them, keyed by locale and
+// message name.
+func NewMessages(overrides map[string]map[string]string) (*Messages, error) {
+	m := &Messages{templates: make(map[string]map[string]*template.Template)}
+
+	files, err := bundledLocales.ReadDir("locales")
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the bundled translations: %w", err)
+	}
+	for _, file := range files {
+		data, err := bundledLocales.ReadFile(path.Join("locales", file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the bundled translation %s: %w", file.Name(), err)
+		}
+		var texts map[string]string
+		err = yaml.Unmarshal(data, &texts)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse the bundled translation %s: %w", file.Name(), err)
+		}
+		err = m.add(strings.TrimSuffix(file.Name(), path.Ext(file.Name())), texts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for locale, texts := range overrides {
+		err = m.add(locale, texts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// DefaultMessages returns the bundled translations. They are tested, so they cannot fail to parse.
+func DefaultMessages() *Messages {
+	m, err := NewMessages(nil)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// checkMessages returns the problems of the message settings of cfg: the overridden messages the bot does not have,
+// and the locales that have neither a bundled translation nor an override for every message.
+func checkMessages(cfg *config.Config) []string {
+	bundled := DefaultMessages()
+	var problems []string
+
+	for locale, texts := range cfg.Messages {
+		for name := range texts {
+			if _, ok := bundled.templates[DefaultLocale][name]; !ok {
+				problems = append(problems, fmt.Sprintf("Messages.%s.%s is not a message of the bot", locale, name))
+			}
+		}
+	}
+	sort.Strings(problems)
+
+	// The locales in use, with the setting that uses them first.
+	locales := map[string]string{cfg.Locale: "Locale"}
+	rooms := make([]string, 0, len(cfg.Rooms))
+	for room := range cfg.Rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	for _, room := range rooms {
+		if locale := cfg.Rooms[room].Locale; locale != nil {
+			if _, ok := locales[*locale]; !ok {
+				locales[*locale] = "Rooms." + room + ".Locale"
+			}
+		}
+	}
+	var unknown []string
+	for locale := range locales {
+		if locale == "" {
+			continue // Reported by the validation of the config.
+		}
+		language := localeLanguage(locale)
+		if bundled.templates[locale] != nil || bundled.templates[language] != nil {
+			continue
+		}
+		missing := 0
+		for name := range bundled.templates[DefaultLocale] {
+			if _, ok := cfg.Messages[locale][name]; !ok {
+				if _, ok := cfg.Messages[language][name]; !ok {
+					missing++
+				}
+			}
+		}
+		if missing > 0 {
+			unknown = append(unknown, fmt.Sprintf("%s: there is no translation for %s, and Messages.%s leaves out %d messages",
+				locales[locale], locale, locale, missing))
+		}
+	}
+	sort.Strings(unknown)
+	return append(problems, unknown...)
+}
+
+// add parses the templates of a locale. They are also executed once, so the unknown fields are reported now
+// instead of when the message is sent.
+func (m *Messages) add(locale string, texts map[string]string) error {
+	if m.templates[locale] == nil {
+		m.templates[locale] = make(map[string]*template.Template)
+	}
+	for name, text := range texts {
+		tmpl, err := template.New(name).Parse(text)
+		if err != nil {
+			return fmt.Errorf("cannot parse the message %s of locale %s: %w", name, locale, err)
+		}
+		err = tmpl.Execute(&bytes.Buffer{}, MessageData{})
+		if err != nil {
+			return fmt.Errorf("cannot render the message %s of locale %s: %w", name, locale, err)
+		}
+		m.templates[locale][name] = tmpl
+	}
+	return nil
+}
+
+// Has tells whether there is a message called name in the locale or in the default locale.
+func (m *Messages) Has(locale string, name string) bool {
+	_, ok := m.lookup(locale, name)
+	return ok
+}
+
+// Render returns the message called name in the locale. A regional locale, e.g. de-AT, falls back to its language,
+// and then to the default locale. If the message does not exist at all, its name is returned.
+func (m *Messages) Render(locale string, name string, data MessageData) string {
+	tmpl, ok := m.lookup(locale, name)
+	if !ok {
+		log.WithField("locale", locale).WithField("message", name).Error("Unknown message.")
+		return name
+	}
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	if err != nil {
+		log.WithError(err).WithField("locale", locale).WithField("message", name).Error("Cannot render message.")
+		return name
+	}
+	return buf.String()
+}
+
+func (m *Messages) lookup(locale string, name string) (*template.Template, bool) {
+	for _, l := range []string{locale, localeLanguage(locale), DefaultLocale} {
+		if tmpl, ok := m.templates[l][name]; ok {
+			return tmpl, true
+		}
+	}
+	return nil, false
+}
+
+// text renders the message called name in the locale of the room of msg. The user, the room and the command prefix
+// are filled in.
+func (b *Bot) text(msg rocket.Message, name string, data MessageData) string {
+	data.User = msg.UserName
+	data.Room = msg.RoomName
+	data.Prefix = CommandPrefix
+	return b.Messages.Render(b.Settings(msg).Locale, name, data)
+}
+
+// limitText tells the author of msg which limit they hit.
+func (b *Bot) limitText(msg rocket.Message, limitErr *LimitError) string {
+	return b.text(msg, "limit_"+limitErr.Kind, MessageData{Limit: limitErr.Limit})
+}
+
+// localeLanguage returns the language of a locale, e.g. de for de-AT.
+func localeLanguage(locale string) string {
+	language := strings.ToLower(locale)
+	if i := strings.IndexAny(language, "-_"); i >= 0 {
+		language = language[:i]
+	}
+	return language
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBundledMessages(t *testing.T) {
+	m, err := NewMessages(nil)
+	require.NoError(t, err)
+
+	// Every translated message has an English original.
+	for locale, templates := range m.templates {
+		for name := range templates {
+			assert.Contains(t, m.templates[DefaultLocale], name, "%s of %s", name, locale)
+		}
+	}
+}
+
+func TestMessagesRender(t *testing.T) {
+	m, err := NewMessages(map[string]map[string]string{
+		"en": {"reset": "Forgot it, {{.User}}."},
+		"hu": {"transcript": ":microphone2: {{.Text}}"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "Forgot it, alice.", m.Render("en", "reset", MessageData{User: "alice"}))
+	assert.Equal(t, "Elfelejtettem, amiről beszélgettünk.", m.Render("hu", "reset", MessageData{}), "the bundled translation is kept")
+	assert.Equal(t, ":microphone2: hello", m.Render("hu", "transcript", MessageData{Text: "hello"}))
+	assert.Equal(t, "Ich habe unsere Unterhaltung vergessen.", m.Render("de-AT", "reset", MessageData{}), "the language of a regional locale is used")
+	assert.Equal(t, "Forgot it, bob.", m.Render("fr", "reset", MessageData{User: "bob"}), "English is used for unknown locales")
+	assert.Equal(t, "The model in this room is gpt-4o.", m.Render("xx", "model", MessageData{Model: "gpt-4o"}))
+	assert.Equal(t, "no_such_message", m.Render("en", "no_such_message", MessageData{}))
+
+	_, err = NewMessages(map[string]map[string]string{"en": {"reset": "{{.User"}})
+	assert.Error(t, err)
+	_, err = NewMessages(map[string]map[string]string{"en": {"reset": "{{.Nickname}}"}})
+	assert.Error(t, err, "unknown fields are reported when the messages are loaded")
+}
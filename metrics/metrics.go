@@ -0,0 +1,101 @@
+// Package metrics holds the Prometheus metrics of the bot. They are registered in the default registry, and served
+// by Handler.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "bartender"
+
+var (
+	MessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_received_total",
+		Help:      "Messages received from Rocket.Chat, by configured room; the others are counted as direct or other.",
+	}, []string{"room"})
+
+	Completions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "completions_total",
+		Help:      "Completion requests, by outcome.",
+	}, []string{"outcome"})
+
+	Moderations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "moderations_total",
+		Help:      "Moderation requests, by the checked text (input or output) and outcome.",
+	}, []string{"kind", "outcome"})
+
+	Flagged = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "flagged_total",
+		Help:      "Texts flagged by the moderation, by kind (input or output).",
+	}, []string{"kind"})
+
+	Duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of the requests to OpenAI and Rocket.Chat, by operation.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 80},
+	}, []string{"operation"})
+
+	Tokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_total",
+		Help:      "Tokens used by the completions, by model and type (prompt or completion).",
+	}, []string{"model", "type"})
+
+	HistoryMessages = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "history_messages",
+		Help:      "The number of history messages sent with the questions.",
+		Buckets:   prometheus.LinearBuckets(0, 5, 10),
+	})
+
+	Reconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_reconnects_total",
+		Help:      "Reconnections of the Rocket.Chat websocket.",
+	})
+)
+
+// The operations measured in Duration.
+const (
+	OperationCompletion  = "completion"
+	OperationModeration  = "moderation"
+	OperationSendMessage = "send_message"
+)
+
+// The outcomes counted in Completions and Moderations.
+const (
+	OutcomeOK      = "ok"
+	OutcomeError   = "error"
+	OutcomeFlagged = "flagged"
+)
+
+func init() {
+	prometheus.MustRegister(MessagesReceived, Completions, Moderations, Flagged, Duration, Tokens, HistoryMessages, Reconnects)
+}
+
+// Since observes the time elapsed since start in Duration.
+func Since(operation string, start time.Time) {
+	Duration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// Outcome returns OutcomeOK if err is nil, and OutcomeError otherwise.
+func Outcome(err error) string {
+	if err != nil {
+		return OutcomeError
+	}
+	return OutcomeOK
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,23 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutcome(t *testing.T) {
+	assert.Equal(t, OutcomeOK, Outcome(nil))
+	assert.Equal(t, OutcomeError, Outcome(errors.New("timeout")))
+}
+
+func TestHandler(t *testing.T) {
+	Completions.WithLabelValues(OutcomeOK).Inc()
+	assert.Equal(t, 1.0, testutil.ToFloat64(Completions.WithLabelValues(OutcomeOK)))
+	count, err := testutil.GatherAndCount(prometheus.DefaultGatherer, "bartender_completions_total")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
@@ -1,5 +1,10 @@
 package openai
 
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
 // https://openai.com/blog/introducing-chatgpt-and-whisper-apis
 
 type CompletionResponse struct {
@@ -13,19 +18,101 @@ type CompletionResponse struct {
 }
 
 type CompletionRequest struct {
-	Model            string    `json:"model"`
-	Messages         []Message `json:"messages"`
-	Temperature      *float64  `json:"temperature,omitempty"`
-	MaxTokens        *int      `json:"max_tokens,omitempty"`
-	TopP             *float64  `json:"top_p,omitempty"`
-	PresencePenalty  *float64  `json:"presence_penalty,omitempty"`
-	FrequencyPenalty *float64  `json:"frequency_penalty,omitempty"`
-	User             *string   `json:"user,omitempty"`
+	Model            string         `json:"model"`
+	Messages         []Message      `json:"messages"`
+	Temperature      *float64       `json:"temperature,omitempty"`
+	MaxTokens        *int           `json:"max_tokens,omitempty"`
+	TopP             *float64       `json:"top_p,omitempty"`
+	PresencePenalty  *float64       `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64       `json:"frequency_penalty,omitempty"`
+	User             *string        `json:"user,omitempty"`
+	Stream           bool           `json:"stream,omitempty"`
+	StreamOptions    *StreamOptions `json:"stream_options,omitempty"`
+	Tools            []Tool         `json:"tools,omitempty"`
+	ToolChoice       string         `json:"tool_choice,omitempty"` // auto (the default), none or required.
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"` // Send the usage in a last chunk without choices.
 }
 
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`   // The tools the assistant wants to call.
+	ToolCallID string     `json:"tool_call_id,omitempty"` // The call a message with the "tool" role answers.
+	Images     []Image    `json:"-"`                      // Sent after Content as image parts, for vision models.
+}
+
+// Image is a picture attached to a user message.
+type Image struct {
+	MediaType string // e.g. image/png
+	Data      []byte
+}
+
+// DataURL returns the image encoded in a data URL.
+func (i Image) DataURL() string {
+	return "data:" + i.MediaType + ";base64," + base64.StdEncoding.EncodeToString(i.Data)
+}
+
+type contentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *imageURL `json:"image_url,omitempty"`
+}
+
+type imageURL struct {
+	URL string `json:"url"`
+}
+
+// MarshalJSON sends the content of the messages with images as a list of parts, and the content of the others as a
+// string, because not every model accepts the list.
+func (r CompletionRequest) MarshalJSON() ([]byte, error) {
+	type request CompletionRequest // Without the MarshalJSON method.
+	messages := make([]interface{}, len(r.Messages))
+	for i, m := range r.Messages {
+		messages[i] = m
+		if len(m.Images) == 0 {
+			continue
+		}
+
+		parts := []contentPart{{Type: "text", Text: m.Content}}
+		for _, image := range m.Images {
+			parts = append(parts, contentPart{Type: "image_url", ImageURL: &imageURL{URL: image.DataURL()}})
+		}
+		messages[i] = struct {
+			Message
+			Content []contentPart `json:"content"`
+		}{m, parts}
+	}
+	return json.Marshal(struct {
+		request
+		Messages []interface{} `json:"messages"`
+	}{request(r), messages})
+}
+
+// Tool is a function the model can ask to be called instead of answering.
+type Tool struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+type FunctionDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"` // JSON schema of the arguments.
+}
+
+type ToolCall struct {
+	Index    int          `json:"index,omitempty"` // Only used in the chunks of streamed completions.
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type,omitempty"`
+	Function FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"` // JSON object, generated by the model, so it may be invalid.
 }
 
 type Choice struct {
@@ -39,3 +126,20 @@ type Usage struct {
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
 }
+
+// CompletionChunk is a server-sent event of a streamed completion.
+type CompletionChunk struct {
+	ID      string        `json:"id"`
+	Object  string        `json:"object"`
+	Created int           `json:"created"`
+	Model   string        `json:"model"`
+	Choices []ChunkChoice `json:"choices"`
+	Usage   *Usage        `json:"usage"` // Only in the last chunk, if it is requested with StreamOptions.
+	Error   HTTPError     `json:"error"`
+}
+
+type ChunkChoice struct {
+	Index        int     `json:"index"`
+	FinishReason string  `json:"finish_reason"`
+	Delta        Message `json:"delta"`
+}
@@ -0,0 +1,119 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// APIError is an error returned by the API. The errors callers may want to handle differently are returned as one of
+// the types embedding it; errors.As finds the APIError in any of them.
+type APIError struct {
+	Status  int    // The HTTP status code. Errors reported in a stream have 200.
+	Type    string // The type of the error, e.g. invalid_request_error.
+	Code    string // The code of the error, e.g. rate_limit_exceeded. Not every error has one.
+	Message string
+}
+
+func (e *APIError) Error() string {
+	s := fmt.Sprintf("status %d", e.Status)
+	if e.Code != "" {
+		s += ", " + e.Code
+	} else if e.Type != "" {
+		s += ", " + e.Type
+	}
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	return s
+}
+
+// As makes errors.As find the APIError embedded in the typed errors.
+func (e *APIError) As(target interface{}) bool {
+	if t, ok := target.(**APIError); ok {
+		*t = e
+		return true
+	}
+	return false
+}
+
+// ErrorContextLengthExceeded is returned if the prompt and the completion do not fit in the context window.
+type ErrorContextLengthExceeded struct{ APIError }
+
+func NewErrorContextLengthExceeded(msg string) error {
+	return &ErrorContextLengthExceeded{APIError{
+		Status:  http.StatusBadRequest,
+		Type:    "invalid_request_error",
+		Code:    "context_length_exceeded",
+		Message: msg,
+	}}
+}
+
+func (e *ErrorContextLengthExceeded) Is(tgt error) bool {
+	_, ok := tgt.(*ErrorContextLengthExceeded)
+	return ok
+}
+
+// ErrorRateLimit is returned if too many requests are sent. It is worth trying again later.
+type ErrorRateLimit struct{ APIError }
+
+// ErrorQuotaExceeded is returned if the account has run out of credit.
+type ErrorQuotaExceeded struct{ APIError }
+
+// ErrorAuth is returned if the API token is invalid or has no access.
+type ErrorAuth struct{ APIError }
+
+// ErrorInvalidModel is returned if the model does not exist or cannot be used.
+type ErrorInvalidModel struct{ APIError }
+
+// ErrorContentPolicy is returned if the request is rejected by the content filter of the provider.
+type ErrorContentPolicy struct{ APIError }
+
+// ErrorServer is returned if the API fails with a 5xx status.
+type ErrorServer struct{ APIError }
+
+// ErrorTimeout is returned if the API does not answer in time.
+type ErrorTimeout struct {
+	Err error
+}
+
+func (e *ErrorTimeout) Error() string {
+	return "timeout: " + e.Err.Error()
+}
+
+func (e *ErrorTimeout) Unwrap() error {
+	return e.Err
+}
+
+// NewAPIError returns the typed error of an error response.
+func NewAPIError(status int, httpErr HTTPError) error {
+	apiErr := APIError{Status: status, Type: httpErr.Type, Code: httpErr.Code, Message: httpErr.Message}
+	switch {
+	case httpErr.Code == "context_length_exceeded":
+		return &ErrorContextLengthExceeded{apiErr}
+	case httpErr.Code == "insufficient_quota":
+		return &ErrorQuotaExceeded{apiErr}
+	case status == http.StatusTooManyRequests || httpErr.Code == "rate_limit_exceeded":
+		return &ErrorRateLimit{apiErr}
+	case status == http.StatusUnauthorized || status == http.StatusForbidden || httpErr.Code == "invalid_api_key":
+		return &ErrorAuth{apiErr}
+	case status == http.StatusNotFound || httpErr.Code == "model_not_found" || httpErr.Code == "DeploymentNotFound":
+		return &ErrorInvalidModel{apiErr}
+	case httpErr.Code == "content_policy_violation" || httpErr.Code == "content_filter":
+		return &ErrorContentPolicy{apiErr}
+	case status >= 500:
+		return &ErrorServer{apiErr}
+	}
+	return &apiErr
+}
+
+// WrapTimeout returns err as an *ErrorTimeout if it was caused by a timeout, and unchanged otherwise.
+func WrapTimeout(err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return &ErrorTimeout{Err: err}
+	}
+	return err
+}
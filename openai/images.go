@@ -0,0 +1,64 @@
+package openai
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// ImageRequest asks for images generated from a prompt.
+type ImageRequest struct {
+	Model          string  `json:"model,omitempty"`
+	Prompt         string  `json:"prompt"`
+	N              int     `json:"n,omitempty"`
+	Size           string  `json:"size,omitempty"`
+	ResponseFormat string  `json:"response_format,omitempty"` // url or b64_json
+	User           *string `json:"user,omitempty"`
+}
+
+type ImageResponse struct {
+	Created int         `json:"created"`
+	Data    []ImageData `json:"data"`
+	Error   HTTPError   `json:"error"`
+}
+
+type ImageData struct {
+	URL           string `json:"url"`
+	B64JSON       string `json:"b64_json"`
+	RevisedPrompt string `json:"revised_prompt"` // The prompt the image was generated from, if the model rewrote it.
+}
+
+// Bytes returns the content of an image requested in the b64_json format.
+func (d ImageData) Bytes() ([]byte, error) {
+	return base64.StdEncoding.DecodeString(d.B64JSON)
+}
+
+func (o *OpenAI) ImageURL() (string, error) {
+	if o.AzureDeployment != "" {
+		return "", errors.New("image generation is not supported with Azure OpenAI")
+	}
+	url, err := url.JoinPath(o.baseURL(), o.ImageEndpoint)
+	if err != nil {
+		return "", err
+	}
+	return url, nil
+}
+
+// Image generates images from the prompt of iReq.
+func (o *OpenAI) Image(ctx context.Context, iReq *ImageRequest) (*ImageResponse, error) {
+	var iResp ImageResponse
+	url, err := o.ImageURL()
+	if err != nil {
+		return nil, fmt.Errorf("cannot assemble endpoint url: %w", err)
+	}
+	err = o.request(ctx, url, iReq, &iResp)
+	if err != nil {
+		return nil, fmt.Errorf("an error occured while performing the request: %w", err)
+	}
+	if len(iResp.Data) == 0 {
+		return nil, fmt.Errorf("no images returned")
+	}
+	return &iResp, nil
+}
@@ -0,0 +1,34 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var iReq ImageRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&iReq))
+		assert.Equal(t, "a cocktail", iReq.Prompt)
+		assert.Equal(t, "b64_json", iReq.ResponseFormat)
+		_, _ = w.Write([]byte(`{"created":1,"data":[{"b64_json":"cG5n","revised_prompt":"a red cocktail"}]}`))
+	}))
+	defer server.Close()
+
+	oa := &OpenAI{
+		BaseURL:       server.URL,
+		ImageEndpoint: "v1/images/generations",
+	}
+	iResp, err := oa.Image(context.Background(), &ImageRequest{Prompt: "a cocktail", ResponseFormat: "b64_json"})
+	if assert.NoError(t, err) {
+		data, err := iResp.Data[0].Bytes()
+		assert.NoError(t, err)
+		assert.Equal(t, "png", string(data))
+		assert.Equal(t, "a red cocktail", iResp.Data[0].RevisedPrompt)
+	}
+}
@@ -2,47 +2,61 @@ package openai
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/retry"
+	"io"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strings"
+	"time"
 )
 
-//var ErrorContextLengthExceeded = errors.New("context length exceeded")
-
-type ErrorContextLengthExceeded struct {
-	message string
-}
-
-func (e *ErrorContextLengthExceeded) Error() string {
-	return e.message
-}
-
-func NewErrorContextLengthExceeded(msg string) error {
-	return &ErrorContextLengthExceeded{msg}
-}
-
-func (e *ErrorContextLengthExceeded) Is(tgt error) bool {
-	_, ok := tgt.(*ErrorContextLengthExceeded)
-	if !ok {
-		return false
-	}
-	return true
-}
-
 type OpenAI struct {
+	Scheme             string // http or https. Local OpenAI-compatible servers often use plain http.
 	HostName           string
+	BaseURL            string // Replaces Scheme and HostName if set, e.g. http://localhost:8080/openai.
 	CompletionEndpoint string
 	ModerationEndpoint string
+	ModelsEndpoint     string // Used by Ping.
 	ApiToken           string
 	PrePrompt          string
 	Model              string
+	ContextWindow      int
 	InputModeration    bool
 	OutputModeration   bool
 	SendUserId         bool
+	Stream             bool          // Stream the answers and show them by editing the reply as they arrive.
+	StreamEditInterval time.Duration // The minimum time between two edits of a streamed reply.
+	Vision             bool          // Send the images attached to the questions to the model.
 	ModelParams        config.ModelParams
+	MaxRetries         int           // The number of retries after a failed request. 0 disables retries.
+	RetryDelay         time.Duration // The base of the exponential backoff between retries.
+	RequestTimeout     time.Duration // The timeout of a single attempt. 0 means no timeout.
+	// Azure OpenAI serves the models from deployments and authenticates with the api-key header. If AzureDeployment
+	// is set, completions are requested from the deployment instead of CompletionEndpoint.
+	AzureDeployment string
+	AzureApiVersion string
+
+	// Audio attachments are transcribed with TranscriptionModel at TranscriptionEndpoint and the transcript is used
+	// as the question, if Transcribe is on.
+	Transcribe            bool
+	TranscriptionEndpoint string
+	TranscriptionModel    string
+	EchoTranscript        bool // Show the transcript in the chat before the answer.
+
+	// Images are generated with ImageModel at ImageEndpoint by the !image command. It is disabled if ImageModel is
+	// empty.
+	ImageEndpoint string
+	ImageModel    string
+	ImageSize     string
+
+	// Client sends the requests. If nil, http.DefaultClient is used.
+	Client *http.Client
 }
 
 type HTTPError struct {
@@ -54,23 +68,66 @@ type HTTPError struct {
 
 func NewFromConfig(config *config.Config) *OpenAI {
 	oa := OpenAI{
+		Scheme:             config.OpenAI.Scheme,
 		HostName:           config.OpenAI.HostName,
+		BaseURL:            config.OpenAI.BaseURL,
 		ApiToken:           config.OpenAI.ApiToken,
 		PrePrompt:          strings.TrimSpace(config.OpenAI.PrePrompt),
 		Model:              config.OpenAI.Model,
+		ContextWindow:      config.OpenAI.ContextWindow,
 		ModerationEndpoint: config.OpenAI.ModerationEndpoint,
 		CompletionEndpoint: config.OpenAI.CompletionEndpoint,
+		ModelsEndpoint:     config.OpenAI.ModelsEndpoint,
 		InputModeration:    config.OpenAI.InputModeration,
 		OutputModeration:   config.OpenAI.OutputModeration,
 		SendUserId:         config.OpenAI.SendUserId,
+		Stream:             config.OpenAI.Stream,
+		StreamEditInterval: config.OpenAI.StreamEditInterval,
+		Vision:             config.OpenAI.Vision,
+		MaxRetries:         config.OpenAI.MaxRetries,
+		RetryDelay:         config.OpenAI.RetryDelay,
+		RequestTimeout:     config.OpenAI.RequestTimeout,
 
 		ModelParams: config.OpenAI.ModelParams,
+
+		Transcribe:            config.OpenAI.Transcribe,
+		TranscriptionEndpoint: config.OpenAI.TranscriptionEndpoint,
+		TranscriptionModel:    config.OpenAI.TranscriptionModel,
+		EchoTranscript:        config.OpenAI.EchoTranscript,
+
+		ImageEndpoint: config.OpenAI.ImageEndpoint,
+		ImageModel:    config.OpenAI.ImageModel,
+		ImageSize:     config.OpenAI.ImageSize,
+	}
+	if config.OpenAI.Provider == "azure" {
+		oa.AzureDeployment = config.OpenAI.AzureDeployment
+		oa.AzureApiVersion = config.OpenAI.AzureApiVersion
 	}
 	return &oa
 }
 
+// PromptBudget returns the number of tokens the prompt may use, so the prompt and a completion of maxTokens fit in
+// the context window of model together. The configured ContextWindow only applies to the configured model.
+func (o *OpenAI) PromptBudget(model string, maxTokens *int) int {
+	window := o.ContextWindow
+	if window == 0 || model != o.Model {
+		window = ContextWindow(model)
+	}
+	if maxTokens != nil {
+		window -= *maxTokens
+	}
+	return window
+}
+
 func (o *OpenAI) CompletionURL() (string, error) {
-	url, err := url.JoinPath("https://", o.HostName, o.CompletionEndpoint)
+	if o.AzureDeployment != "" {
+		u, err := url.JoinPath(o.baseURL(), "openai/deployments", o.AzureDeployment, "chat/completions")
+		if err != nil {
+			return "", err
+		}
+		return u + "?api-version=" + url.QueryEscape(o.AzureApiVersion), nil
+	}
+	url, err := url.JoinPath(o.baseURL(), o.CompletionEndpoint)
 	if err != nil {
 		return "", err
 	}
@@ -78,45 +135,83 @@ func (o *OpenAI) CompletionURL() (string, error) {
 }
 
 func (o *OpenAI) ModerationURL() (string, error) {
-	url, err := url.JoinPath("https://", o.HostName, o.ModerationEndpoint)
+	if o.AzureDeployment != "" {
+		return "", errors.New("Azure OpenAI has no moderation endpoint")
+	}
+	url, err := url.JoinPath(o.baseURL(), o.ModerationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	return url, nil
+}
+
+func (o *OpenAI) ModelsURL() (string, error) {
+	if o.AzureDeployment != "" {
+		u, err := url.JoinPath(o.baseURL(), "openai/models")
+		if err != nil {
+			return "", err
+		}
+		return u + "?api-version=" + url.QueryEscape(o.AzureApiVersion), nil
+	}
+	url, err := url.JoinPath(o.baseURL(), o.ModelsEndpoint)
+	if err != nil {
+		return "", err
+	}
+	return url, nil
+}
+
+func (o *OpenAI) TranscriptionURL() (string, error) {
+	if o.AzureDeployment != "" {
+		return "", errors.New("transcription is not supported with Azure OpenAI")
+	}
+	url, err := url.JoinPath(o.baseURL(), o.TranscriptionEndpoint)
 	if err != nil {
 		return "", err
 	}
 	return url, nil
 }
 
-func (o *OpenAI) Completion(cReq *CompletionRequest) (*CompletionResponse, error) {
+func (o *OpenAI) baseURL() string {
+	if o.BaseURL != "" {
+		return strings.TrimSuffix(o.BaseURL, "/")
+	}
+	scheme := o.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	return scheme + "://" + o.HostName
+}
+
+func (o *OpenAI) Completion(ctx context.Context, cReq *CompletionRequest) (*CompletionResponse, error) {
 	var cResp CompletionResponse
 	url, err := o.CompletionURL()
 	if err != nil {
 		return nil, fmt.Errorf("cannot assemble endpoint url: %w", err)
 	}
-	err = o.request(url, cReq, &cResp)
-	if cResp.Error.Code == "context_length_exceeded" {
-		return nil, NewErrorContextLengthExceeded(cResp.Error.Message)
-	} else if cResp.Error.Message != "" {
-		return nil, fmt.Errorf("%w: %s ", err, cResp.Error.Message)
-	}
-	// All other errors
+	err = o.request(ctx, url, cReq, &cResp)
 	if err != nil {
-		return &cResp, fmt.Errorf("an error occured while performing the request: %w", err)
+		return nil, fmt.Errorf("an error occured while performing the request: %w", err)
+	}
+	if cResp.Error.Message != "" {
+		// Some compatible servers report errors with a 200 status.
+		return nil, NewAPIError(http.StatusOK, cResp.Error)
 	}
 
 	return &cResp, nil
 }
 
-func (o *OpenAI) Moderation(mReq *ModerationRequest) (*ModerationResponse, error) {
+func (o *OpenAI) Moderation(ctx context.Context, mReq *ModerationRequest) (*ModerationResponse, error) {
 	var mResp ModerationResponse
 	url, err := o.ModerationURL()
 	if err != nil {
 		return nil, fmt.Errorf("cannot assemble endpoint url: %w", err)
 	}
-	err = o.request(url, mReq, &mResp)
-	if mResp.Error.Message != "" {
-		return nil, fmt.Errorf("%w: %s ", err, mResp.Error.Message)
-	}
+	err = o.request(ctx, url, mReq, &mResp)
 	if err != nil {
-		return &mResp, fmt.Errorf("an error occured during performing the request: %w", err)
+		return nil, fmt.Errorf("an error occured during performing the request: %w", err)
+	}
+	if mResp.Error.Message != "" {
+		return nil, NewAPIError(http.StatusOK, mResp.Error)
 	}
 
 	if len(mResp.ID) == 0 {
@@ -127,35 +222,117 @@ func (o *OpenAI) Moderation(mReq *ModerationRequest) (*ModerationResponse, error
 	return &mResp, nil
 }
 
-func (o *OpenAI) request(url string, request interface{}, oaResponse interface{}) error {
+// request sends request to url and decodes the answer into oaResponse. Network errors, timeouts, 429 and 5xx
+// responses are retried with jittered exponential backoff, honoring the Retry-After header.
+func (o *OpenAI) request(ctx context.Context, url string, request interface{}, oaResponse interface{}) error {
+	return o.send(ctx, url, request, oaResponse, func(body io.Reader) error {
+		err := json.NewDecoder(body).Decode(oaResponse)
+		if err != nil {
+			return fmt.Errorf("cannot parse response body: %w", err)
+		}
+		return nil
+	})
+}
+
+// send posts request to url as JSON, retrying like request does, and passes the body of the first successful
+// response to handle. Error responses are decoded into oaResponse.
+func (o *OpenAI) send(ctx context.Context, url string, request interface{}, oaResponse interface{}, handle func(body io.Reader) error) error {
 	data, err := json.Marshal(request)
 	if err != nil {
 		return fmt.Errorf("cannot marshal request body: %w", err)
 	}
+	return o.post(ctx, url, "application/json; charset=UTF-8", data, oaResponse, handle)
+}
+
+// post posts data of contentType to url, retrying like request does. Timeouts are returned as *ErrorTimeout.
+func (o *OpenAI) post(ctx context.Context, url string, contentType string, data []byte, oaResponse interface{}, handle func(body io.Reader) error) error {
+	policy := retry.Policy{
+		MaxRetries: o.MaxRetries,
+		Delay:      o.RetryDelay,
+		Timeout:    o.RequestTimeout,
+	}
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		o.authorize(req)
+		return req, nil
+	}
+
+	err := policy.Do(ctx, o.client(), newRequest, func(resp *http.Response) error {
+		// Start from an empty response, so nothing is left over from a failed attempt.
+		reset(oaResponse)
+		if resp.StatusCode != 200 {
+			err := parseError(resp, oaResponse)
+			if isRetryableStatus(resp, err) {
+				return retry.Retryable(err, retry.ParseRetryAfter(resp.Header.Get("Retry-After")))
+			}
+			return err
+		}
+		return handle(resp.Body)
+	})
+	return WrapTimeout(err)
+}
+
+// authorize sets the credentials on req.
+func (o *OpenAI) authorize(req *http.Request) {
+	if o.AzureDeployment != "" {
+		req.Header.Set("api-key", o.ApiToken)
+	} else if o.ApiToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", o.ApiToken))
+	}
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+// Ping checks that the API can be reached with the configured credentials, by listing the models. It is not retried.
+func (o *OpenAI) Ping(ctx context.Context) error {
+	url, err := o.ModelsURL()
+	if err != nil {
+		return fmt.Errorf("cannot assemble endpoint url: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return fmt.Errorf("cannot create new request: %w", err)
+		return fmt.Errorf("cannot create request: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", o.ApiToken))
+	o.authorize(req)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := o.client().Do(req)
 	if err != nil {
-		return fmt.Errorf("cannot perform request: %w", err)
+		return WrapTimeout(err)
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return parseError(resp, oaResponse)
+	if resp.StatusCode != http.StatusOK {
+		return parseError(resp, &struct{}{})
 	}
+	return nil
+}
 
-	err = json.NewDecoder(resp.Body).Decode(oaResponse)
-	if err != nil {
-		return fmt.Errorf("cannot parse response body: %w", err)
+func (o *OpenAI) client() *http.Client {
+	if o.Client != nil {
+		return o.Client
+	}
+	return http.DefaultClient
+}
+
+func isRetryableStatus(resp *http.Response, err error) bool {
+	if resp.StatusCode >= 500 {
+		return true
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		// Running out of quota is reported with 429 too, but waiting does not help on it.
+		var quotaErr *ErrorQuotaExceeded
+		return !errors.As(err, &quotaErr)
 	}
+	return false
+}
 
-	return nil
+// reset sets the value v points to to its zero value.
+func reset(v interface{}) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+	}
 }
 
 func (o *OpenAI) NewCompletionRequest(messages []Message, user string) *CompletionRequest {
@@ -176,15 +353,25 @@ func (o *OpenAI) NewCompletionRequest(messages []Message, user string) *Completi
 	return r
 }
 
+// parseError decodes the body of an error response into oaResponse, and returns the typed error of the response.
 func parseError(resp *http.Response, oaResponse interface{}) error {
 	if resp.Body == nil {
-		return fmt.Errorf("HTTP Error: %d", resp.StatusCode)
+		return NewAPIError(resp.StatusCode, HTTPError{})
 	}
 
-	err := json.NewDecoder(resp.Body).Decode(oaResponse)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return NewAPIError(resp.StatusCode, HTTPError{Message: "the response body is not available: " + err.Error()})
+	}
+	err = json.Unmarshal(body, oaResponse)
 	if err != nil {
-		return fmt.Errorf("HTTP Error: %d but response body is not available: %w", resp.StatusCode, err)
+		// e.g. an HTML error page of a proxy.
+		return NewAPIError(resp.StatusCode, HTTPError{Message: http.StatusText(resp.StatusCode)})
 	}
 
-	return fmt.Errorf("Non-OK status code: %d", resp.StatusCode)
+	var errResponse struct {
+		Error HTTPError `json:"error"`
+	}
+	_ = json.Unmarshal(body, &errResponse)
+	return NewAPIError(resp.StatusCode, errResponse.Error)
 }
@@ -0,0 +1,96 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRetryableStatus(t *testing.T) {
+	assert.True(t, isRetryableStatus(&http.Response{StatusCode: 500}, NewAPIError(500, HTTPError{})))
+	assert.True(t, isRetryableStatus(&http.Response{StatusCode: 429}, NewAPIError(429, HTTPError{Code: "rate_limit_exceeded"})))
+	assert.False(t, isRetryableStatus(&http.Response{StatusCode: 429}, NewAPIError(429, HTTPError{Code: "insufficient_quota"})))
+	assert.False(t, isRetryableStatus(&http.Response{StatusCode: 400}, NewAPIError(400, HTTPError{})))
+}
+
+func TestNewAPIError(t *testing.T) {
+	err := NewAPIError(429, HTTPError{Type: "requests", Code: "rate_limit_exceeded", Message: "Slow down."})
+	var rateErr *ErrorRateLimit
+	if assert.True(t, errors.As(err, &rateErr)) {
+		assert.Equal(t, 429, rateErr.Status)
+		assert.Equal(t, "requests", rateErr.Type)
+		assert.Equal(t, "rate_limit_exceeded", rateErr.Code)
+	}
+	assert.Equal(t, "status 429, rate_limit_exceeded: Slow down.", err.Error())
+
+	// Every typed error is an APIError.
+	var apiErr *APIError
+	assert.True(t, errors.As(fmt.Errorf("wrapped: %w", err), &apiErr))
+	assert.Equal(t, 429, apiErr.Status)
+
+	assert.IsType(t, &ErrorQuotaExceeded{}, NewAPIError(429, HTTPError{Code: "insufficient_quota"}))
+	assert.IsType(t, &ErrorAuth{}, NewAPIError(401, HTTPError{Code: "invalid_api_key"}))
+	assert.IsType(t, &ErrorInvalidModel{}, NewAPIError(404, HTTPError{Code: "model_not_found"}))
+	assert.IsType(t, &ErrorContentPolicy{}, NewAPIError(400, HTTPError{Code: "content_policy_violation"}))
+	assert.IsType(t, &ErrorContextLengthExceeded{}, NewAPIError(400, HTTPError{Code: "context_length_exceeded"}))
+	assert.IsType(t, &ErrorServer{}, NewAPIError(503, HTTPError{}))
+	assert.IsType(t, &APIError{}, NewAPIError(400, HTTPError{Code: "invalid_value"}))
+
+	assert.IsType(t, &ErrorTimeout{}, WrapTimeout(fmt.Errorf("cannot perform request: %w", context.DeadlineExceeded)))
+	assert.Nil(t, WrapTimeout(nil))
+}
+
+func TestCompletionURL(t *testing.T) {
+	oa := &OpenAI{HostName: "api.openai.com", CompletionEndpoint: "v1/chat/completions"}
+	url, err := oa.CompletionURL()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://api.openai.com/v1/chat/completions", url)
+
+	oa = &OpenAI{Scheme: "http", HostName: "localhost:11434", CompletionEndpoint: "v1/chat/completions"}
+	url, err = oa.CompletionURL()
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:11434/v1/chat/completions", url)
+
+	oa = &OpenAI{HostName: "api.openai.com", BaseURL: "http://localhost:8080/openai/", CompletionEndpoint: "v1/chat/completions"}
+	url, err = oa.CompletionURL()
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080/openai/v1/chat/completions", url)
+
+	oa = &OpenAI{HostName: "example.openai.azure.com", AzureDeployment: "gpt35", AzureApiVersion: "2024-02-01"}
+	url, err = oa.CompletionURL()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.openai.azure.com/openai/deployments/gpt35/chat/completions?api-version=2024-02-01", url)
+	_, err = oa.ModerationURL()
+	assert.Error(t, err, "Azure has no moderation endpoint")
+	_, err = oa.TranscriptionURL()
+	assert.Error(t, err, "the chat deployment cannot transcribe")
+	_, err = oa.ImageURL()
+	assert.Error(t, err, "the chat deployment cannot draw")
+}
+
+func TestCompletionRequestMarshalJSON(t *testing.T) {
+	data, err := json.Marshal(CompletionRequest{
+		Model: "gpt-4o",
+		Messages: []Message{
+			{Role: "system", Content: "Hello"},
+			{
+				Role:    "user",
+				Content: "What is wrong?",
+				Images:  []Image{{MediaType: "image/png", Data: []byte("png")}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"model":"gpt-4o","messages":[
+		{"role":"system","content":"Hello"},
+		{"role":"user","content":[
+			{"type":"text","text":"What is wrong?"},
+			{"type":"image_url","image_url":{"url":"data:image/png;base64,cG5n"}}
+		]}
+	]}`, string(data))
+}
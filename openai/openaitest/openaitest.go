@@ -0,0 +1,346 @@
+// Package openaitest is an in-process fake of the OpenAI API for tests. It serves the chat completions (streamed
+// too), the moderations, the image generation and the models endpoints. The responses can be scripted, including errors and slow
+// responses, and every request is recorded.
+package openaitest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+)
+
+// ApiToken is the only token the server accepts.
+const ApiToken = "sk-test"
+
+// The paths of the endpoints.
+const (
+	CompletionPath = "/v1/chat/completions"
+	ModerationPath = "/v1/moderations"
+	ModelsPath     = "/v1/models"
+	ImagePath      = "/v1/images/generations"
+)
+
+// ImageData is the content of the images the server draws.
+var ImageData = []byte("not really a png")
+
+// Response is a scripted response of the server.
+type Response struct {
+	Status int         // 200 if 0.
+	Header http.Header // Added to the headers of the response.
+	Body   interface{} // Sent as JSON. A successful completion is sent as a stream of chunks if it is requested.
+	// Delay is waited before responding. The response is not sent if the client gives up in the meantime.
+	Delay time.Duration
+}
+
+// Request is a request received by the server.
+type Request struct {
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// Decode parses the JSON body of the request into v.
+func (r Request) Decode(v interface{}) error {
+	return json.Unmarshal(r.Body, v)
+}
+
+// Completion returns a successful completion answering content.
+func Completion(content string) Response {
+	return Response{Body: openai.CompletionResponse{
+		ID:      "chatcmpl-test",
+		Object:  "chat.completion",
+		Created: int(time.Now().Unix()),
+		Model:   "gpt-3.5-turbo",
+		Choices: []openai.Choice{{
+			FinishReason: "stop",
+			Message:      openai.Message{Role: "assistant", Content: content},
+		}},
+		Usage: openai.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15},
+	}}
+}
+
+// Moderation returns a moderation result. It is flagged if any category is given; the known categories are hate,
+// harassment, self-harm, sexual and violence.
+func Moderation(categories ...string) Response {
+	var result openai.Result
+	for _, category := range categories {
+		switch category {
+		case "hate":
+			result.Categories.Hate = true
+		case "harassment":
+			result.Categories.Harassment = true
+		case "self-harm":
+			result.Categories.SelfHarm = true
+		case "sexual":
+			result.Categories.Sexual = true
+		case "violence":
+			result.Categories.Violence = true
+		}
+	}
+	result.Flagged = len(categories) > 0
+	return Response{Body: openai.ModerationResponse{
+		ID:      "modr-test",
+		Model:   "text-moderation-007",
+		Results: []openai.Result{result},
+	}}
+}
+
+// Error returns an error response in the format of the API.
+func Error(status int, errType string, code string, message string) Response {
+	return Response{
+		Status: status,
+		Body: map[string]interface{}{
+			"error": openai.HTTPError{Message: message, Type: errType, Code: code},
+		},
+	}
+}
+
+// ContextLengthExceeded returns the error of a prompt that does not fit in the context window of the model.
+func ContextLengthExceeded() Response {
+	return Error(http.StatusBadRequest, "invalid_request_error", "context_length_exceeded",
+		"This model's maximum context length is 4097 tokens. However, your messages resulted in 5000 tokens. Please reduce the length of the messages.")
+}
+
+// RateLimited returns a 429 Too Many Requests response, asking the client to retry after retryAfter, in whole
+// seconds. If it is 0, the client decides.
+func RateLimited(retryAfter time.Duration) Response {
+	r := Error(http.StatusTooManyRequests, "requests", "rate_limit_exceeded",
+		"Rate limit reached for requests. Please try again later.")
+	if retryAfter > 0 {
+		r.Header = http.Header{"Retry-After": {strconv.Itoa(int(retryAfter.Seconds()))}}
+	}
+	return r
+}
+
+// ServerError returns a 500 Internal Server Error response.
+func ServerError() Response {
+	return Error(http.StatusInternalServerError, "server_error", "",
+		"The server had an error while processing your request. Sorry about that!")
+}
+
+// Server is a fake OpenAI API listening on a local port.
+type Server struct {
+	http *httptest.Server
+
+	mutex       sync.Mutex
+	completions []Response
+	moderations []Response
+	requests    []Request
+}
+
+// NewServer starts a fake server. It is stopped by Close.
+func NewServer() *Server {
+	s := &Server{}
+	s.http = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.http.Close()
+}
+
+// URL is the base URL of the API, e.g. http://127.0.0.1:12345.
+func (s *Server) URL() string {
+	return s.http.URL
+}
+
+// Configure points the OpenAI section of cfg to the server.
+func (s *Server) Configure(cfg *config.Config) {
+	cfg.OpenAI.BaseURL = s.URL()
+	cfg.OpenAI.ApiToken = ApiToken
+	cfg.OpenAI.CompletionEndpoint = strings.TrimPrefix(CompletionPath, "/")
+	cfg.OpenAI.ModerationEndpoint = strings.TrimPrefix(ModerationPath, "/")
+	cfg.OpenAI.ModelsEndpoint = strings.TrimPrefix(ModelsPath, "/")
+	cfg.OpenAI.ImageEndpoint = strings.TrimPrefix(ImagePath, "/")
+}
+
+// QueueCompletions adds responses to the completion requests, used in order. When none is left, the completions
+// repeat the last message of the request.
+func (s *Server) QueueCompletions(responses ...Response) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.completions = append(s.completions, responses...)
+}
+
+// QueueModerations adds responses to the moderation requests, used in order. When none is left, nothing is flagged.
+func (s *Server) QueueModerations(responses ...Response) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.moderations = append(s.moderations, responses...)
+}
+
+// Requests returns the requests received on path, or every request if path is empty.
+func (s *Server) Requests(path string) []Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var requests []Request
+	for _, r := range s.requests {
+		if path == "" || r.Path == path {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+// CompletionRequests returns the completion requests received. The messages with images are left out, because
+// their content is not a string.
+func (s *Server) CompletionRequests() []openai.CompletionRequest {
+	var cReqs []openai.CompletionRequest
+	for _, r := range s.Requests(CompletionPath) {
+		var cReq openai.CompletionRequest
+		if r.Decode(&cReq) == nil {
+			cReqs = append(cReqs, cReq)
+		}
+	}
+	return cReqs
+}
+
+// ModerationInputs returns the texts sent to the moderation endpoint.
+func (s *Server) ModerationInputs() []string {
+	var inputs []string
+	for _, r := range s.Requests(ModerationPath) {
+		var mReq openai.ModerationRequest
+		if r.Decode(&mReq) == nil {
+			inputs = append(inputs, mReq.Input)
+		}
+	}
+	return inputs
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mutex.Lock()
+	s.requests = append(s.requests, Request{Path: r.URL.Path, Header: r.Header.Clone(), Body: body})
+	s.mutex.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer "+ApiToken {
+		write(w, Error(http.StatusUnauthorized, "invalid_request_error", "invalid_api_key",
+			"Incorrect API key provided. You can find your API key at https://platform.openai.com/account/api-keys."))
+		return
+	}
+
+	var response Response
+	stream := false
+	switch r.URL.Path {
+	case CompletionPath:
+		var cReq struct {
+			Stream   bool `json:"stream"`
+			Messages []struct {
+				Content interface{} `json:"content"`
+			} `json:"messages"`
+		}
+		if json.Unmarshal(body, &cReq) != nil {
+			write(w, Error(http.StatusBadRequest, "invalid_request_error", "", "We could not parse the JSON body of your request."))
+			return
+		}
+		stream = cReq.Stream
+		response = s.next(&s.completions, func() Response {
+			content := ""
+			if len(cReq.Messages) > 0 {
+				content = fmt.Sprint(cReq.Messages[len(cReq.Messages)-1].Content)
+			}
+			return Completion(content)
+		})
+	case ModerationPath:
+		response = s.next(&s.moderations, func() Response { return Moderation() })
+	case ImagePath:
+		response = Response{Body: openai.ImageResponse{
+			Created: int(time.Now().Unix()),
+			Data:    []openai.ImageData{{B64JSON: base64.StdEncoding.EncodeToString(ImageData)}},
+		}}
+	case ModelsPath:
+		response = Response{Body: map[string]interface{}{
+			"object": "list",
+			"data":   []interface{}{map[string]interface{}{"id": "gpt-3.5-turbo", "object": "model"}},
+		}}
+	default:
+		response = Error(http.StatusNotFound, "invalid_request_error", "unknown_url", "Unknown request URL: "+r.URL.Path)
+	}
+
+	if response.Delay > 0 {
+		select {
+		case <-time.After(response.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if completion, ok := response.Body.(openai.CompletionResponse); ok && stream && response.Status == 0 {
+		writeStream(w, response, completion)
+		return
+	}
+	write(w, response)
+}
+
+// next takes the first response of queue, or returns fallback if it is empty.
+func (s *Server) next(queue *[]Response, fallback func() Response) Response {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(*queue) == 0 {
+		return fallback()
+	}
+	response := (*queue)[0]
+	*queue = (*queue)[1:]
+	return response
+}
+
+func write(w http.ResponseWriter, response Response) {
+	for key, values := range response.Header {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Content-Type", "application/json")
+	status := response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response.Body)
+}
+
+// writeStream sends completion as server-sent events: the words of the answer one by one, then the finish reason
+// and the usage.
+func writeStream(w http.ResponseWriter, response Response, completion openai.CompletionResponse) {
+	for key, values := range response.Header {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(chunk openai.CompletionChunk) {
+		chunk.ID, chunk.Object, chunk.Created, chunk.Model = completion.ID, "chat.completion.chunk", completion.Created, completion.Model
+		data, _ := json.Marshal(chunk)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+
+	var choice openai.Choice
+	if len(completion.Choices) > 0 {
+		choice = completion.Choices[0]
+	}
+	content := choice.Message.Content
+	for content != "" {
+		// Split after the next space, so the pieces put together give back the content.
+		end := strings.Index(content, " ") + 1
+		if end == 0 {
+			end = len(content)
+		}
+		send(openai.CompletionChunk{Choices: []openai.ChunkChoice{{Delta: openai.Message{Content: content[:end]}}}})
+		content = content[end:]
+	}
+	send(openai.CompletionChunk{Choices: []openai.ChunkChoice{{FinishReason: choice.FinishReason}}})
+	usage := completion.Usage
+	send(openai.CompletionChunk{Choices: []openai.ChunkChoice{}, Usage: &usage})
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
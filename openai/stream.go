@@ -0,0 +1,140 @@
+package openai
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// CompletionStream performs a streamed completion request. onDelta is called with every piece of the answer as it
+// arrives. When the stream ends, the assembled response is returned as if Completion had been called.
+func (o *OpenAI) CompletionStream(ctx context.Context, cReq *CompletionRequest, onDelta func(delta string)) (*CompletionResponse, error) {
+	url, err := o.CompletionURL()
+	if err != nil {
+		return nil, fmt.Errorf("cannot assemble endpoint url: %w", err)
+	}
+
+	streamReq := *cReq
+	streamReq.Stream = true
+	streamReq.StreamOptions = &StreamOptions{IncludeUsage: true}
+
+	var cResp CompletionResponse
+	var content strings.Builder
+	var toolCalls []ToolCall
+	err = o.send(ctx, url, &streamReq, &cResp, func(body io.Reader) error {
+		return ReadEvents(body, func(data []byte) error {
+			var chunk CompletionChunk
+			err := json.Unmarshal(data, &chunk)
+			if err != nil {
+				return fmt.Errorf("cannot parse stream chunk: %w", err)
+			}
+			if chunk.Error.Message != "" {
+				cResp.Error = chunk.Error
+				return NewAPIError(http.StatusOK, chunk.Error)
+			}
+
+			cResp.ID, cResp.Object, cResp.Created, cResp.Model = chunk.ID, "chat.completion", chunk.Created, chunk.Model
+			if chunk.Usage != nil {
+				cResp.Usage = *chunk.Usage
+			}
+			for _, choice := range chunk.Choices {
+				if choice.Index != 0 {
+					continue
+				}
+				if choice.FinishReason != "" {
+					cResp.Choices = []Choice{{FinishReason: choice.FinishReason}}
+				}
+				if choice.Delta.Content != "" {
+					content.WriteString(choice.Delta.Content)
+					onDelta(choice.Delta.Content)
+				}
+				toolCalls = mergeToolCalls(toolCalls, choice.Delta.ToolCalls)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("an error occured while performing the request: %w", err)
+	}
+
+	if len(cResp.Choices) == 0 {
+		cResp.Choices = []Choice{{}}
+	}
+	cResp.Choices[0].Message = Message{
+		Role:      "assistant",
+		Content:   content.String(),
+		ToolCalls: toolCalls,
+	}
+	return &cResp, nil
+}
+
+// mergeToolCalls adds the pieces of tool calls in a chunk to the calls assembled so far. The id, the type and the
+// name arrive in the first piece of a call, the arguments are split between the pieces.
+func mergeToolCalls(calls []ToolCall, deltas []ToolCall) []ToolCall {
+	for _, delta := range deltas {
+		for len(calls) <= delta.Index {
+			calls = append(calls, ToolCall{})
+		}
+		call := &calls[delta.Index]
+		if delta.ID != "" {
+			call.ID = delta.ID
+		}
+		if delta.Type != "" {
+			call.Type = delta.Type
+		}
+		if delta.Function.Name != "" {
+			call.Function.Name = delta.Function.Name
+		}
+		call.Function.Arguments += delta.Function.Arguments
+	}
+	// The index is only meaningful in chunks.
+	for i := range calls {
+		calls[i].Index = 0
+	}
+	return calls
+}
+
+// ReadEvents reads server-sent events from body and calls onData with the data of every event until the stream
+// ends or the [DONE] event arrives.
+func ReadEvents(body io.Reader, onData func(data []byte) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			// An empty line dispatches the event.
+			if len(data) == 0 {
+				continue
+			}
+			payload := strings.Join(data, "\n")
+			data = data[:0]
+			if payload == "[DONE]" {
+				return nil
+			}
+			err := onData([]byte(payload))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, "data:") {
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// Comments (":") and the other fields (event, id, retry) are not used by OpenAI.
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("cannot read stream: %w", err)
+	}
+	if len(data) > 0 && strings.Join(data, "\n") != "[DONE]" {
+		return onData([]byte(strings.Join(data, "\n")))
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package openai
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadEvents(t *testing.T) {
+	body := `: keep-alive comment
+
+data: {"choices":[{"index":0,"delta":{"role":"assistant"}}]}
+
+data: {"choices":[{"index":0,"delta":{"content":"Hel"}}]}
+
+data: {"choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}]}
+
+data: [DONE]
+
+data: {"never":"read"}
+
+`
+	var events []string
+	err := ReadEvents(strings.NewReader(body), func(data []byte) error {
+		events = append(events, string(data))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		`{"choices":[{"index":0,"delta":{"role":"assistant"}}]}`,
+		`{"choices":[{"index":0,"delta":{"content":"Hel"}}]}`,
+		`{"choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}]}`,
+	}, events)
+}
+
+func TestReadEventsWithoutTrailingNewline(t *testing.T) {
+	var events []string
+	err := ReadEvents(strings.NewReader("data: first\n\ndata: last"), func(data []byte) error {
+		events = append(events, string(data))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first", "last"}, events)
+}
+
+func TestMergeToolCalls(t *testing.T) {
+	var calls []ToolCall
+	calls = mergeToolCalls(calls, []ToolCall{{Index: 0, ID: "call_1", Type: "function", Function: FunctionCall{Name: "get_message"}}})
+	calls = mergeToolCalls(calls, []ToolCall{{Index: 0, Function: FunctionCall{Arguments: `{"message_`}}})
+	calls = mergeToolCalls(calls, []ToolCall{{Index: 1, ID: "call_2", Type: "function", Function: FunctionCall{Name: "list_room_members"}}})
+	calls = mergeToolCalls(calls, []ToolCall{{Index: 0, Function: FunctionCall{Arguments: `id": "abc"}`}}})
+
+	assert.Equal(t, []ToolCall{
+		{ID: "call_1", Type: "function", Function: FunctionCall{Name: "get_message", Arguments: `{"message_id": "abc"}`}},
+		{ID: "call_2", Type: "function", Function: FunctionCall{Name: "list_room_members"}},
+	}, calls)
+}
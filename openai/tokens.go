@@ -0,0 +1,102 @@
+package openai
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+func init() {
+	// Use the BPE files embedded in the binary instead of downloading them on the first use.
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// contextWindows is the number of tokens the models can handle, prompt and completion together. The most specific
+// prefix wins.
+var contextWindows = map[string]int{
+	"gpt-4o":                 128000,
+	"gpt-4-turbo":            128000,
+	"gpt-4-1106":             128000,
+	"gpt-4-0125":             128000,
+	"gpt-4-32k":              32768,
+	"gpt-4":                  8192,
+	"gpt-3.5-turbo-16k":      16385,
+	"gpt-3.5-turbo-1106":     16385,
+	"gpt-3.5-turbo-0125":     16385,
+	"gpt-3.5-turbo-instruct": 4096,
+	"gpt-3.5-turbo":          4096,
+	"claude-":                200000,
+}
+
+// imageTokens is an estimate of the tokens an image uses. The exact number depends on its size, this is the cost of a
+// 1024x1024 image in high detail.
+const imageTokens = 765
+
+// DefaultContextWindow is used for models that are not known.
+const DefaultContextWindow = 4096
+
+var (
+	encodings      = make(map[string]*tiktoken.Tiktoken)
+	encodingsMutex sync.Mutex
+)
+
+// ContextWindow returns the size of the context window of model in tokens.
+func ContextWindow(model string) int {
+	window, matched := DefaultContextWindow, ""
+	for prefix, w := range contextWindows {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(matched) {
+			window, matched = w, prefix
+		}
+	}
+	return window
+}
+
+// CountTokens returns the number of prompt tokens messages use when they are sent to model. It follows
+// https://github.com/openai/openai-cookbook/blob/main/examples/How_to_count_tokens_with_tiktoken.ipynb so the
+// result is exact for OpenAI chat models and a close estimate for others.
+func CountTokens(model string, messages []Message) int {
+	encoding := encodingForModel(model)
+
+	tokens := 3 // Every reply is primed with <|start|>assistant<|message|>
+	for _, m := range messages {
+		tokens += 3 // <|start|>{role}<|message|>{content}<|end|>
+		tokens += countText(encoding, m.Role)
+		tokens += countText(encoding, m.Content)
+		tokens += len(m.Images) * imageTokens
+	}
+	return tokens
+}
+
+// CountTextTokens returns the number of tokens text uses when it is sent to model.
+func CountTextTokens(model string, text string) int {
+	return countText(encodingForModel(model), text)
+}
+
+func countText(encoding *tiktoken.Tiktoken, text string) int {
+	if encoding == nil {
+		// A rough estimate, a token is about 4 characters of english text.
+		return (len(text) + 3) / 4
+	}
+	return len(encoding.EncodeOrdinary(text))
+}
+
+// encodingForModel returns the tokenizer of model, or cl100k_base if the model is unknown (e.g. a local model).
+func encodingForModel(model string) *tiktoken.Tiktoken {
+	encodingsMutex.Lock()
+	defer encodingsMutex.Unlock()
+
+	if encoding, ok := encodings[model]; ok {
+		return encoding
+	}
+	encoding, err := tiktoken.EncodingForModel(model)
+	if err != nil {
+		encoding, err = tiktoken.GetEncoding("cl100k_base")
+	}
+	if err != nil {
+		encoding = nil
+	}
+	encodings[model] = encoding
+	return encoding
+}
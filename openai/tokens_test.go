@@ -0,0 +1,39 @@
+package openai
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountTokens(t *testing.T) {
+	messages := []Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "Hello world"},
+	}
+	// 3 for priming, 3 per message, "system" and "user" are 1 token each, the contents are 6 and 2 tokens.
+	assert.Equal(t, 3+3+1+6+3+1+2, CountTokens("gpt-3.5-turbo", messages))
+
+	// Unknown models are counted with cl100k_base.
+	assert.Equal(t, CountTokens("gpt-3.5-turbo", messages), CountTokens("llama3", messages))
+}
+
+func TestContextWindow(t *testing.T) {
+	assert.Equal(t, 4096, ContextWindow("gpt-3.5-turbo"))
+	assert.Equal(t, 16385, ContextWindow("gpt-3.5-turbo-16k-0613"))
+	assert.Equal(t, 8192, ContextWindow("gpt-4-0613"))
+	assert.Equal(t, 32768, ContextWindow("gpt-4-32k"))
+	assert.Equal(t, DefaultContextWindow, ContextWindow("llama3"))
+}
+
+func TestPromptBudget(t *testing.T) {
+	maxTokens := 1024
+	oa := &OpenAI{Model: "gpt-4"}
+	assert.Equal(t, 8192-1024, oa.PromptBudget("gpt-4", &maxTokens))
+	assert.Equal(t, 8192, oa.PromptBudget("gpt-4", nil))
+
+	oa.ContextWindow = 2048
+	assert.Equal(t, 2048-1024, oa.PromptBudget("gpt-4", &maxTokens))
+	// The configured context window is not used for other models.
+	assert.Equal(t, 32768-1024, oa.PromptBudget("gpt-4-32k", &maxTokens))
+}
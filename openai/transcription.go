@@ -0,0 +1,74 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+)
+
+// TranscriptionRequest asks for the text of an audio file.
+type TranscriptionRequest struct {
+	Model    string
+	FileName string // The extension tells the format of the audio.
+	File     []byte
+	Language string // ISO-639-1 code of the language, optional.
+}
+
+type TranscriptionResponse struct {
+	Text  string    `json:"text"`
+	Error HTTPError `json:"error"`
+}
+
+// Transcription converts the speech in an audio file to text.
+func (o *OpenAI) Transcription(ctx context.Context, tReq *TranscriptionRequest) (*TranscriptionResponse, error) {
+	var tResp TranscriptionResponse
+	url, err := o.TranscriptionURL()
+	if err != nil {
+		return nil, fmt.Errorf("cannot assemble endpoint url: %w", err)
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	err = tReq.write(form)
+	if err != nil {
+		return nil, fmt.Errorf("cannot assemble request body: %w", err)
+	}
+
+	err = o.post(ctx, url, form.FormDataContentType(), body.Bytes(), &tResp, func(body io.Reader) error {
+		err := json.NewDecoder(body).Decode(&tResp)
+		if err != nil {
+			return fmt.Errorf("cannot parse response body: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("an error occured while performing the request: %w", err)
+	}
+	return &tResp, nil
+}
+
+// write writes the fields of tReq to form and closes it.
+func (tReq *TranscriptionRequest) write(form *multipart.Writer) error {
+	err := form.WriteField("model", tReq.Model)
+	if err != nil {
+		return err
+	}
+	if tReq.Language != "" {
+		err = form.WriteField("language", tReq.Language)
+		if err != nil {
+			return err
+		}
+	}
+	file, err := form.CreateFormFile("file", tReq.FileName)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(tReq.File)
+	if err != nil {
+		return err
+	}
+	return form.Close()
+}
@@ -0,0 +1,43 @@
+package openai
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranscription(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/audio/transcriptions", r.URL.Path)
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		assert.Equal(t, "whisper-1", r.FormValue("model"))
+
+		file, header, err := r.FormFile("file")
+		if assert.NoError(t, err) {
+			data, _ := io.ReadAll(file)
+			assert.Equal(t, "recording.mp3", header.Filename)
+			assert.Equal(t, "audio", string(data))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"text":"Hello bartender"}`))
+	}))
+	defer server.Close()
+
+	oa := &OpenAI{
+		BaseURL:               server.URL,
+		ApiToken:              "secret",
+		TranscriptionEndpoint: "v1/audio/transcriptions",
+	}
+	tresp, err := oa.Transcription(context.Background(), &TranscriptionRequest{
+		Model:    "whisper-1",
+		FileName: "recording.mp3",
+		File:     []byte("audio"),
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Hello bartender", tresp.Text)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+)
+
+// DefaultRecapMessages is the number of messages !summarize summarizes without arguments.
+const DefaultRecapMessages = 50
+
+// MaxRecapMessages is the most messages !summarize fetches. Older ones would not fit in the prompt anyway.
+const MaxRecapMessages = 1000
+
+// RecapPrompt asks the model to summarize the messages of a room.
+const RecapPrompt = "Below are the latest messages of a chat room. Summarize them for someone who has not read " +
+	"them: the topics discussed, the decisions made, the questions left open and who is waiting for what. Be brief " +
+	"and write in the language of the messages."
+
+func recapCommand(ctx context.Context, b *Bot, msg rocket.Message, args string) error {
+	count, since, err := parseRecapArgs(args)
+	var argsErr *RecapArgsError
+	if errors.As(err, &argsErr) {
+		invalid := b.text(msg, "summarize_invalid_"+argsErr.Kind, MessageData{Text: argsErr.Arg})
+		return reply(msg, b.text(msg, "summarize_usage", MessageData{Error: invalid}))
+	} else if err != nil {
+		return err
+	}
+
+	err = b.Limits.Check(msg.UserId, msg.RoomId)
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return reply(msg, b.limitText(msg, limitErr))
+	} else if err != nil {
+		return fmt.Errorf("cannot check the limits: %w", err)
+	}
+
+	msg.SetIsTyping(true)
+	defer msg.SetIsTyping(false)
+
+	var oldest time.Time
+	if since > 0 {
+		oldest = time.Now().Add(-since)
+	}
+	// The command itself is among the latest messages.
+	messages, err := b.Rocket.RoomHistory(msg.RoomId, count+1, oldest)
+	if err != nil {
+		return fmt.Errorf("cannot get the history of the room: %w", err)
+	}
+
+	settings := b.Settings(msg)
+	system := openai.Message{Role: "system", Content: RecapPrompt}
+	budget := b.OpenAI.PromptBudget(settings.Model, settings.ModelParams.MaxTokens) - openai.CountTokens(settings.Model, []openai.Message{system})
+	// The message that holds the transcript needs a few tokens besides the lines.
+	budget -= openai.CountTokens(settings.Model, []openai.Message{{Role: "user"}})
+	transcript := packTranscript(messages, msg.Id, b.Rocket.OwnUserId(), budget, func(line string) int {
+		return openai.CountTextTokens(settings.Model, line+"\n")
+	})
+	if len(transcript) == 0 {
+		return reply(msg, b.text(msg, "summarize_empty", MessageData{}))
+	}
+
+	cReq := &openai.CompletionRequest{
+		Model:     settings.Model,
+		MaxTokens: settings.ModelParams.MaxTokens,
+		Messages: []openai.Message{
+			system,
+			{Role: "user", Content: strings.Join(transcript, "\n")},
+		},
+	}
+	cresp, err := b.Chat.Completion(ctx, cReq)
+	if err != nil {
+		return fmt.Errorf("cannot perform completion request: %w", err)
+	}
+	if len(cresp.Choices) == 0 {
+		return fmt.Errorf("no choices returned")
+	}
+	b.recordUsage(msg, cReq, cresp)
+
+	return reply(msg, b.text(msg, "summary", MessageData{Count: len(transcript), Text: cresp.Choices[0].Message.Content}))
+}
+
+// RecapArgsError tells what is wrong with the arguments of !summarize. The users are told with the
+// summarize_invalid_<kind> message.
+type RecapArgsError struct {
+	Kind string // period, count or arguments.
+	Arg  string // The invalid argument.
+}
+
+func (e *RecapArgsError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Kind, e.Arg)
+}
+
+// parseRecapArgs parses the arguments of !summarize: a number of messages (e.g. "100" or "100 messages") or a
+// period (e.g. "since 2h" or "since 3d"). The error is a *RecapArgsError.
+func parseRecapArgs(args string) (count int, since time.Duration, err error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return DefaultRecapMessages, 0, nil
+	}
+
+	if fields[0] == "since" && len(fields) == 2 {
+		period := fields[1]
+		if strings.HasSuffix(period, "d") {
+			days, err := strconv.Atoi(strings.TrimSuffix(period, "d"))
+			if err != nil || days <= 0 {
+				return 0, 0, &RecapArgsError{Kind: "period", Arg: period}
+			}
+			return MaxRecapMessages, time.Duration(days) * 24 * time.Hour, nil
+		}
+		since, err := time.ParseDuration(period)
+		if err != nil || since <= 0 {
+			return 0, 0, &RecapArgsError{Kind: "period", Arg: period}
+		}
+		return MaxRecapMessages, since, nil
+	}
+
+	if len(fields) == 1 || (len(fields) == 2 && fields[1] == "messages") {
+		count, err := strconv.Atoi(fields[0])
+		if err != nil || count <= 0 {
+			return 0, 0, &RecapArgsError{Kind: "count", Arg: fields[0]}
+		}
+		if count > MaxRecapMessages {
+			count = MaxRecapMessages
+		}
+		return count, 0, nil
+	}
+	return 0, 0, &RecapArgsError{Kind: "arguments", Arg: args}
+}
+
+// packTranscript formats messages (newest first) as lines in chronological order. The command (commandId) and the
+// messages of the bot (botId) are left out, and the oldest messages are dropped if the lines would use more than
+// budget tokens, as counted by count.
+func packTranscript(messages []rocket.Message, commandId string, botId string, budget int, count func(line string) int) []string {
+	var lines []string
+	for _, m := range messages {
+		if m.Id == commandId || m.UserId == botId || strings.TrimSpace(m.Text) == "" {
+			continue
+		}
+		line := fmt.Sprintf("[%s] %s: %s", m.Timestamp.Format("2006-01-02 15:04"), m.UserName, m.Text)
+		budget -= count(line)
+		if budget < 0 {
+			break
+		}
+		lines = append(lines, line)
+	}
+	// Chronological order.
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines
+}
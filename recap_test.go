@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRecapArgs(t *testing.T) {
+	tests := []struct {
+		args  string
+		count int
+		since time.Duration
+		err   string // The kind of the error.
+	}{
+		{"", DefaultRecapMessages, 0, ""},
+		{"100", 100, 0, ""},
+		{"20 messages", 20, 0, ""},
+		{"5000", MaxRecapMessages, 0, ""},
+		{"since 2h", MaxRecapMessages, 2 * time.Hour, ""},
+		{"since 3d", MaxRecapMessages, 72 * time.Hour, ""},
+		{"since yesterday", 0, 0, "period"},
+		{"-1", 0, 0, "count"},
+		{"everything please", 0, 0, "arguments"},
+	}
+	for _, test := range tests {
+		count, since, err := parseRecapArgs(test.args)
+		if test.err != "" {
+			var argsErr *RecapArgsError
+			if assert.ErrorAs(t, err, &argsErr, test.args) {
+				assert.Equal(t, test.err, argsErr.Kind, test.args)
+			}
+			continue
+		}
+		assert.NoError(t, err, test.args)
+		assert.Equal(t, test.count, count, test.args)
+		assert.Equal(t, test.since, since, test.args)
+	}
+}
+
+func TestPackTranscript(t *testing.T) {
+	at := time.Date(2023, 5, 31, 12, 0, 0, 0, time.UTC)
+	// Newest first, like RoomHistory returns them.
+	messages := []rocket.Message{
+		{Id: "5", UserName: "alice", Text: "@bot !summarize", Timestamp: at.Add(4 * time.Minute)},
+		{Id: "4", UserName: "bot", UserId: "bot-id", Text: "Hi there", Timestamp: at.Add(3 * time.Minute)},
+		{Id: "3", UserName: "bob", Text: "the deploy is done", Timestamp: at.Add(2 * time.Minute)},
+		{Id: "2", UserName: "carol", Text: "is the deploy done?", Timestamp: at.Add(time.Minute)},
+		{Id: "1", UserName: "dave", Text: "good morning", Timestamp: at},
+	}
+	count := func(line string) int { return 1 }
+
+	assert.Equal(t, []string{
+		"[2023-05-31 12:00] dave: good morning",
+		"[2023-05-31 12:01] carol: is the deploy done?",
+		"[2023-05-31 12:02] bob: the deploy is done",
+	}, packTranscript(messages, "5", "bot-id", 10, count))
+
+	// The oldest messages are dropped when they do not fit.
+	assert.Equal(t, []string{
+		"[2023-05-31 12:01] carol: is the deploy done?",
+		"[2023-05-31 12:02] bob: the deploy is done",
+	}, packTranscript(messages, "5", "bot-id", 2, count))
+}
@@ -0,0 +1,123 @@
+// Package retry sends HTTP requests again when they fail with an error that waiting can fix.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxDelay caps the exponential backoff. A Retry-After header can still ask for more.
+const MaxDelay = time.Minute
+
+// Policy tells how failed requests are retried.
+type Policy struct {
+	MaxRetries int           // The number of retries after a failed request. 0 disables retries.
+	Delay      time.Duration // The base of the exponential backoff between retries.
+	Timeout    time.Duration // The timeout of a single attempt. 0 means no timeout.
+}
+
+// Error marks an error of a request that can be retried.
+type Error struct {
+	Err        error
+	RetryAfter time.Duration // The delay the server asked for, 0 if it did not ask.
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Retryable marks err as retryable. retryAfter is the minimum delay before the next attempt.
+func Retryable(err error, retryAfter time.Duration) error {
+	return &Error{Err: err, RetryAfter: retryAfter}
+}
+
+// Do sends the request made by newRequest and passes the response to handle, until handle succeeds, returns an error
+// that is not marked with Retryable or the retries run out. Network errors and timeouts are retried too. The body of
+// the response is closed after handle returns.
+func (p Policy) Do(ctx context.Context, client *http.Client, newRequest func(ctx context.Context) (*http.Request, error), handle func(resp *http.Response) error) error {
+	for attempt := 0; ; attempt++ {
+		err := p.attempt(ctx, client, newRequest, handle)
+
+		var retryErr *Error
+		if !errors.As(err, &retryErr) {
+			return err
+		}
+		if attempt >= p.MaxRetries {
+			return retryErr.Err
+		}
+
+		delay := p.Backoff(attempt, retryErr.RetryAfter)
+		log.WithError(retryErr.Err).WithField("attempt", attempt+1).WithField("retryIn", delay).Warn("Request failed, retrying.")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("gave up retrying: %w", ctx.Err())
+		}
+	}
+}
+
+func (p Policy) attempt(ctx context.Context, client *http.Client, newRequest func(ctx context.Context) (*http.Request, error), handle func(resp *http.Response) error) error {
+	parent := ctx
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	req, err := newRequest(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot create new request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("cannot perform request: %w", err)
+		if parent.Err() != nil {
+			// The caller gave up, there is no point in retrying.
+			return err
+		}
+		return Retryable(err, 0)
+	}
+	defer resp.Body.Close()
+
+	return handle(resp)
+}
+
+// Backoff returns the delay before the retry after the given attempt: a random duration between half and all of
+// Delay * 2^attempt, or retryAfter if it is longer.
+func (p Policy) Backoff(attempt int, retryAfter time.Duration) time.Duration {
+	delay := p.Delay << attempt
+	if delay > MaxDelay || delay <= 0 {
+		delay = MaxDelay
+	}
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	return delay
+}
+
+// ParseRetryAfter parses the Retry-After header, that is either a number of seconds or a HTTP date.
+func ParseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
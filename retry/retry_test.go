@@ -0,0 +1,77 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	p := Policy{Delay: time.Second}
+
+	for attempt := 0; attempt < 4; attempt++ {
+		delay := p.Backoff(attempt, 0)
+		full := time.Second << attempt
+		assert.GreaterOrEqual(t, delay, full/2)
+		assert.LessOrEqual(t, delay, full)
+	}
+
+	// The backoff is capped...
+	assert.LessOrEqual(t, p.Backoff(30, 0), MaxDelay)
+	// ...but the server can ask for a longer wait.
+	assert.Equal(t, 5*time.Minute, p.Backoff(0, 5*time.Minute))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), ParseRetryAfter(""))
+	assert.Equal(t, 7*time.Second, ParseRetryAfter("7"))
+	assert.Equal(t, time.Duration(0), ParseRetryAfter("soon"))
+
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	assert.InDelta(t, float64(time.Minute), float64(ParseRetryAfter(date)), float64(2*time.Second))
+}
+
+func TestDo(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+	}
+	handle := func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			return Retryable(errors.New(resp.Status), 0)
+		}
+		return nil
+	}
+
+	p := Policy{MaxRetries: 1, Delay: time.Millisecond}
+	assert.Error(t, p.Do(context.Background(), http.DefaultClient, newRequest, handle))
+	assert.Equal(t, 2, attempts)
+
+	attempts = 0
+	p.MaxRetries = 3
+	assert.NoError(t, p.Do(context.Background(), http.DefaultClient, newRequest, handle))
+	assert.Equal(t, 3, attempts)
+
+	// Errors that are not marked retryable are returned immediately.
+	attempts = 0
+	err := p.Do(context.Background(), http.DefaultClient, newRequest, func(resp *http.Response) error {
+		return errors.New("bad request")
+	})
+	assert.EqualError(t, err, "bad request")
+	assert.Equal(t, 1, attempts)
+}
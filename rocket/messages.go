@@ -1,8 +1,10 @@
 package rocket
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,6 +20,7 @@ type Message struct {
 	UserId      string              `yaml:"UserId"`
 	RoomName    string              `yaml:"RoomName"`
 	RoomId      string              `yaml:"RoomId"`
+	ThreadId    string              `yaml:"ThreadId"` // The id of the first message of the thread, empty if not in a thread.
 	Text        string              `yaml:"Text"`
 	Timestamp   time.Time           `yaml:"Timestamp"`
 	UpdatedAt   time.Time           `yaml:"UpdatedAt"`
@@ -33,14 +36,105 @@ type attachment struct {
 	Title       string
 	Type        string
 	Link        string
+	ImageURL    string // The path of the image on the server, if the attachment is an image.
+	ImageType   string // The MIME type of the image.
+	AudioURL    string // The path of the recording on the server, if the attachment is an audio message.
+	AudioType   string // The MIME type of the recording.
+}
+
+// IsImage tells whether the attachment is an uploaded image.
+func (a attachment) IsImage() bool {
+	return a.ImageURL != "" && strings.HasPrefix(a.ImageType, "image/")
+}
+
+// IsAudio tells whether the attachment is an uploaded recording.
+func (a attachment) IsAudio() bool {
+	return a.AudioURL != "" && strings.HasPrefix(a.AudioType, "audio/")
 }
 
 var lastMessageTime time.Time
+var lastMessageTimeMutex sync.Mutex
 
 func init() {
 	lastMessageTime = time.Now()
 }
 
+// parseAttachments reads the attachments of the message object obj. If msg has no text, the text typed when uploading
+// a file, which is the description of its attachment, is used.
+func (msg *Message) parseAttachments(obj map[string]interface{}) {
+	if attachments, ok := obj["attachments"].([]interface{}); ok {
+		msg.Attachments = make([]attachment, 0)
+		for _, val := range attachments {
+			obj, ok := val.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			var attach attachment
+			attach.Description, _ = obj["description"].(string)
+			attach.Title, _ = obj["title"].(string)
+			attach.Link, _ = obj["title_link"].(string)
+			attach.Type, _ = obj["type"].(string)
+			attach.ImageURL, _ = obj["image_url"].(string)
+			attach.ImageType, _ = obj["image_type"].(string)
+			attach.AudioURL, _ = obj["audio_url"].(string)
+			attach.AudioType, _ = obj["audio_type"].(string)
+			msg.Attachments = append(msg.Attachments, attach)
+		}
+	}
+
+	if msg.Text == "" {
+		for _, attach := range msg.Attachments {
+			if attach.Description != "" {
+				msg.Text = attach.Description
+				break
+			}
+		}
+	}
+}
+
+// parseRESTMessage parses a message object returned by the REST API, e.g. by chat.getMessage or the history of a
+// room. Unlike handleMessageObject, it does not change the state of the connection, and it returns an error instead of
+// panicking on a malformed object.
+func (rock *RocketCon) parseRESTMessage(obj map[string]interface{}) (Message, error) {
+	var msg Message
+	msg.rocketCon = rock
+	msg.Id, _ = obj["_id"].(string)
+	msg.RoomId, _ = obj["rid"].(string)
+	if msg.Id == "" || msg.RoomId == "" {
+		return Message{}, errors.New("malformed message object: no id or room id")
+	}
+	user, _ := obj["u"].(map[string]interface{})
+	msg.UserId, _ = user["_id"].(string)
+	msg.UserName, _ = user["username"].(string)
+	msg.Text, _ = obj["msg"].(string)
+	msg.ThreadId, _ = obj["tmid"].(string)
+	_, msg.IsEdited = obj["editedAt"]
+	msg.IsMe = msg.UserId != "" && msg.UserId == rock.OwnUserId()
+	msg.Timestamp = parseTime(obj["ts"])
+	msg.parseAttachments(obj)
+
+	rock.channelsMutex.RLock()
+	msg.RoomName = rock.channels[msg.RoomId]
+	rock.channelsMutex.RUnlock()
+	msg.IsDirect = msg.RoomName != "" && msg.RoomName == msg.UserName
+	return msg, nil
+}
+
+// parseTime parses a time of the API: an EJSON date ({"$date": milliseconds}) or an ISO 8601 string. It returns the
+// zero time if v is neither.
+func parseTime(v interface{}) time.Time {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if ms, ok := v["$date"].(float64); ok {
+			return time.UnixMilli(int64(ms))
+		}
+	case string:
+		t, _ := time.Parse("2006-01-02T15:04:05.999999999Z", v)
+		return t
+	}
+	return time.Time{}
+}
+
 func (rock *RocketCon) handleMessageObject(obj map[string]interface{}) Message {
 	var msg Message
 	msg.rocketCon = rock
@@ -54,22 +148,13 @@ func (rock *RocketCon) handleMessageObject(obj map[string]interface{}) Message {
 	msg.RoomId = obj["rid"].(string)
 	msg.UserId = obj["u"].(map[string]interface{})["_id"].(string)
 	msg.UserName = obj["u"].(map[string]interface{})["username"].(string)
-
-	if attachments, ok := obj["attachments"]; ok && attachments != nil {
-		msg.Attachments = make([]attachment, 0)
-		for _, val := range attachments.([]interface{}) {
-			if _, ok := val.(map[string]interface{})["description"]; ok {
-				var attach attachment
-				attach.Description = val.(map[string]interface{})["description"].(string)
-				attach.Title = val.(map[string]interface{})["title"].(string)
-				attach.Link = val.(map[string]interface{})["title_link"].(string)
-				attach.Type = val.(map[string]interface{})["type"].(string)
-				msg.Attachments = append(msg.Attachments, attach)
-			}
-		}
+	if tmid, ok := obj["tmid"].(string); ok {
+		msg.ThreadId = tmid
 	}
 
-	if msg.UserId == rock.UserId {
+	msg.parseAttachments(obj)
+
+	if msg.UserId == rock.OwnUserId() {
 		msg.IsMe = true
 	}
 
@@ -126,7 +211,10 @@ func (rock *RocketCon) handleMessageObject(obj map[string]interface{}) Message {
 		}
 	}
 
-	if val, ok := rock.channels[msg.RoomId]; ok {
+	rock.channelsMutex.RLock()
+	val, ok := rock.channels[msg.RoomId]
+	rock.channelsMutex.RUnlock()
+	if ok {
 		msg.RoomName = val
 		if msg.RoomName == msg.UserName {
 			msg.IsDirect = true
@@ -144,17 +232,25 @@ func (rock *RocketCon) handleMessageObject(obj map[string]interface{}) Message {
 		}
 	}
 
+	lastMessageTimeMutex.Lock()
 	if msg.Timestamp.After(lastMessageTime) {
 		lastMessageTime = msg.Timestamp
 	} else {
 		msg.IsNew = false
 	}
+	lastMessageTimeMutex.Unlock()
 
 	return msg
 }
 
+// Reply sends text to the room of msg. If msg is in a thread, the reply goes to the same thread.
 func (msg *Message) Reply(text string) (Message, error) {
-	return msg.rocketCon.SendMessage(msg.RoomId, text)
+	return msg.rocketCon.SendThreadMessage(msg.RoomId, msg.ThreadId, text)
+}
+
+// ReplyWithFile uploads a file to the room (or thread) of msg, with text shown above it.
+func (msg *Message) ReplyWithFile(fileName string, data []byte, text string) error {
+	return msg.rocketCon.UploadFile(msg.RoomId, msg.ThreadId, fileName, data, text)
 }
 
 func (msg *Message) DM(text string) (Message, error) {
@@ -172,10 +268,12 @@ func (msg *Message) React(emoji string) error {
 	return msg.rocketCon.React(msg.Id, emoji)
 }
 
+// GetNotAddressedText returns the text of msg without the leading mention of the bot. The case of the text is kept.
 func (msg *Message) GetNotAddressedText() string {
 	r := msg.Text
 	if len(msg.Text) > 2 && msg.AmIPinged {
-		r = string(strings.ToLower(msg.Text)[len(msg.rocketCon.UserName)+2:])
+		// AmIPinged means the text starts with "@username ", whatever the case of the username is.
+		r = msg.Text[len(msg.rocketCon.UserName)+2:]
 	}
 	return r
 }
@@ -1,17 +1,22 @@
 package rocket
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/metrics"
 
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
@@ -27,9 +32,11 @@ type RocketCon struct {
 	HostSSL       bool   `yaml:"ssl"`
 	HostPort      uint16 `yaml:"port"`
 	session       string
+	status        string // The temporary status set by UserTemporaryStatus, restored after reconnecting.
+	authMutex     sync.RWMutex
 	channels      map[string]string
-	send          chan interface{}
-	receive       chan interface{}
+	roomTypes     map[string]string // c: channel, p: private group, d: direct messages. Guarded by channelsMutex.
+	channelsMutex sync.RWMutex
 	results       map[string]chan map[string]interface{}
 	resultsMutex  sync.RWMutex
 	resultsAppend chan struct {
@@ -40,7 +47,57 @@ type RocketCon struct {
 	nextId      chan string
 	messages    chan Message
 	newMessages chan Message
+	conn        *connection
+	connMutex   sync.Mutex
+	connChanged chan struct{}
 	quit        chan struct{}
+	closeOnce   sync.Once
+}
+
+// connection is a single websocket session to the Rocket.Chat server. A new one is created every time the bot
+// reconnects, so packets queued for a lost session are never sent on the next one.
+type connection struct {
+	ws        *websocket.Conn
+	send      chan interface{}
+	done      chan struct{} // Closed when the websocket cannot be read anymore.
+	loggedIn  bool          // Set by handshake, before the connection is used by anything else.
+	lastPing  time.Time     // The last DDP ping or websocket pong from the server.
+	pingMutex sync.Mutex
+}
+
+func (conn *connection) pinged() {
+	conn.pingMutex.Lock()
+	conn.lastPing = time.Now()
+	conn.pingMutex.Unlock()
+}
+
+// Status is the state of the connection to the server.
+type Status struct {
+	Connected bool      // The websocket is open.
+	LoggedIn  bool      // The bot is logged in on the websocket.
+	LastPing  time.Time // The last DDP ping or websocket pong from the server, or the time of connecting.
+}
+
+// Status returns the state of the current connection.
+func (rock *RocketCon) Status() Status {
+	rock.connMutex.Lock()
+	conn := rock.conn
+	rock.connMutex.Unlock()
+
+	var status Status
+	if conn == nil {
+		return status
+	}
+	select {
+	case <-conn.done:
+	default:
+		status.Connected = true
+		status.LoggedIn = conn.loggedIn
+	}
+	conn.pingMutex.Lock()
+	status.LastPing = conn.lastPing
+	conn.pingMutex.Unlock()
+	return status
 }
 
 const STATUS_ONLINE string = "online"
@@ -48,6 +105,15 @@ const STATUS_BUSY string = "busy"
 const STATUS_AWAY string = "away"
 const STATUS_OFFLINE string = "offline"
 
+// Delays between reconnection attempts. The delay doubles after every failed attempt.
+const reconnectMinDelay = time.Second
+const reconnectMaxDelay = 2 * time.Minute
+
+var ErrConnectionClosed = errors.New("The rocket connection has been closed")
+
+// ErrMessageNotFound is returned if a message does not exist or the bot cannot see it.
+var ErrMessageNotFound = errors.New("message not found")
+
 func NewConnection(domain string, username string, password string) (*RocketCon, error) {
 	var rock RocketCon
 	rock.HostName = domain
@@ -97,8 +163,6 @@ func NewConnectionFromConfig(config *config.Config) (*RocketCon, error) {
 
 func (rock *RocketCon) init() error {
 	// Init variables
-	rock.send = make(chan interface{}, 1024)
-	rock.receive = make(chan interface{}, 1024)
 	rock.resultsAppend = make(chan struct {
 		string  string
 		channel chan map[string]interface{}
@@ -108,43 +172,240 @@ func (rock *RocketCon) init() error {
 	rock.nextId = make(chan string, 0)
 	rock.messages = make(chan Message, 1024)
 	rock.newMessages = make(chan Message, 1024)
+	rock.connChanged = make(chan struct{})
 	rock.quit = make(chan struct{}, 0)
 	rock.channels = make(map[string]string)
+	rock.roomTypes = make(map[string]string)
 
-	go rock.run()
+	// Manage Method/Subscription Ids
+	go func() {
+		for i := uint64(0); ; i++ {
+			i++
+			rock.nextId <- fmt.Sprintf("%d", i)
+		}
+	}()
+
+	// Manage Results map
+	go func() {
+		for {
+			select {
+			case addition := <-rock.resultsAppend:
+				rock.resultsMutex.Lock()
+				rock.results[addition.string] = addition.channel
+				rock.resultsMutex.Unlock()
+			case remove := <-rock.resultsDel:
+				rock.resultsMutex.Lock()
+				delete(rock.results, remove)
+				rock.resultsMutex.Unlock()
+			}
+		}
+	}()
+
+	// The first connection is not retried: if it fails, the configuration is most likely wrong.
+	conn, err := rock.dial()
+	if err != nil {
+		rock.Close()
+		return err
+	}
 
 	// Send Init Messages
-	rock.connect()
-	err := rock.login()
+	err = rock.handshake(conn)
 	if err != nil {
-		close(rock.quit)
+		conn.ws.Close()
+		rock.Close()
 		return err
 	}
 
 	if rock.UserName == "" {
-		rock.UserName = rock.RequestUserName(rock.UserId)
+		rock.UserName = rock.RequestUserName(rock.OwnUserId())
 	}
 
-	rock.subscribeRooms()
-	rock.DisplayName, _ = rock.RequestDisplayName(rock.UserId)
+	err = rock.subscribeRooms(conn)
+	if err != nil {
+		conn.ws.Close()
+		rock.Close()
+		return err
+	}
+	rock.setConnection(conn)
+
+	rock.DisplayName, _ = rock.RequestDisplayName(rock.OwnUserId())
+
+	go rock.maintain()
 	return nil
 }
 
-func (rock *RocketCon) run() {
-	// Set some websocket tunables
-	const socketreadsizelimit = 65536
-	const pingtime = 120 * time.Second
-	const timeout = 125 * time.Second
+// Close shuts down the connection permanently. GetMessage and GetNewMessage return ErrConnectionClosed afterwards.
+func (rock *RocketCon) Close() {
+	rock.closeOnce.Do(func() {
+		close(rock.quit)
+		rock.connMutex.Lock()
+		if rock.conn != nil {
+			rock.conn.ws.Close()
+		}
+		rock.connMutex.Unlock()
+	})
+}
+
+// maintain waits for the current connection to drop and reconnects with exponential backoff until it succeeds or
+// the RocketCon is closed.
+func (rock *RocketCon) maintain() {
+	for {
+		rock.connMutex.Lock()
+		conn := rock.conn
+		rock.connMutex.Unlock()
+
+		select {
+		case <-conn.done:
+		case <-rock.quit:
+			return
+		}
+		log.Warn("Connection to rocketchat lost, reconnecting.")
 
+		delay := reconnectMinDelay
+		for {
+			select {
+			case <-time.After(delay):
+			case <-rock.quit:
+				return
+			}
+
+			err := rock.reconnect()
+			if err == nil {
+				metrics.Reconnects.Inc()
+				log.Info("Reconnected to rocketchat.")
+				break
+			}
+
+			delay *= 2
+			if delay > reconnectMaxDelay {
+				delay = reconnectMaxDelay
+			}
+			log.WithError(err).WithField("retryIn", delay).Warn("Cannot reconnect to rocketchat.")
+		}
+	}
+}
+
+func (rock *RocketCon) reconnect() error {
+	conn, err := rock.dial()
+	if err != nil {
+		return err
+	}
+	err = rock.handshake(conn)
+	if err != nil {
+		conn.ws.Close()
+		return err
+	}
+	err = rock.subscribeRooms(conn)
+	if err != nil {
+		conn.ws.Close()
+		return err
+	}
+	rock.setConnection(conn)
+
+	// The presence of the bot is tied to the session, so the new one starts offline.
+	rock.authMutex.RLock()
+	status := rock.status
+	rock.authMutex.RUnlock()
+	if status != "" {
+		err = rock.UserTemporaryStatus(status)
+		if err != nil {
+			log.WithError(err).WithField("status", status).Warn("Cannot restore the status after reconnecting.")
+		}
+	}
+	return nil
+}
+
+// OwnUserId returns the user id of the bot. Unlike the UserId field, it is safe to call while the connection is
+// being restored, when the id is written by the login.
+func (rock *RocketCon) OwnUserId() string {
+	rock.authMutex.RLock()
+	defer rock.authMutex.RUnlock()
+	return rock.UserId
+}
+
+// setConnection makes conn the connection used for method calls and wakes up callers waiting for a connection.
+func (rock *RocketCon) setConnection(conn *connection) {
+	rock.connMutex.Lock()
+	defer rock.connMutex.Unlock()
+	rock.conn = conn
+	close(rock.connChanged)
+	rock.connChanged = make(chan struct{})
+}
+
+// readyConnection returns the current connection. If the bot is reconnecting, it blocks until the new connection is
+// ready, so callers do not notice short outages.
+func (rock *RocketCon) readyConnection() (*connection, error) {
+	for {
+		rock.connMutex.Lock()
+		conn, changed := rock.conn, rock.connChanged
+		rock.connMutex.Unlock()
+
+		if conn != nil {
+			select {
+			case <-conn.done:
+			default:
+				return conn, nil
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-rock.quit:
+			return nil, ErrConnectionClosed
+		}
+	}
+}
+
+// dial opens a new websocket and starts serving it.
+func (rock *RocketCon) dial() (*connection, error) {
 	// Define Websocket URL
 	wsURL := rock.getWsURL()
 
 	// Init websocket
 	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
 	if err != nil {
-		log.WithError(err).WithField("wsURL", wsURL).Error("Cannot initiate websocket")
-		close(rock.quit)
+		return nil, fmt.Errorf("cannot initiate websocket to %s: %w", wsURL, err)
 	}
+
+	conn := &connection{
+		ws:       ws,
+		send:     make(chan interface{}, 1024),
+		done:     make(chan struct{}),
+		lastPing: time.Now(),
+	}
+	go rock.run(conn)
+	return conn, nil
+}
+
+// handshake sends the DDP connect message and logs in. If the resume token has expired, it falls back to the
+// password if there is one.
+func (rock *RocketCon) handshake(conn *connection) error {
+	rock.connect(conn)
+
+	rock.authMutex.RLock()
+	resuming := rock.AuthToken != ""
+	rock.authMutex.RUnlock()
+
+	err := rock.login(conn)
+	if err != nil && resuming && rock.Password != "" {
+		log.WithError(err).Warn("Cannot log in with the resume token, trying the password.")
+		rock.authMutex.Lock()
+		rock.AuthToken = ""
+		rock.authMutex.Unlock()
+		err = rock.login(conn)
+	}
+	conn.loggedIn = err == nil
+	return err
+}
+
+func (rock *RocketCon) run(conn *connection) {
+	// Set some websocket tunables
+	const socketreadsizelimit = 65536
+	const pingtime = 120 * time.Second
+	const timeout = 125 * time.Second
+
+	ws := conn.ws
+	defer close(conn.done)
 	defer ws.Close()
 
 	// Configure Websocket using Tunables
@@ -152,43 +413,32 @@ func (rock *RocketCon) run() {
 	ws.SetReadDeadline(time.Now().Add(timeout))
 	ws.SetPongHandler(func(string) error {
 		ws.SetReadDeadline(time.Now().Add(timeout))
+		conn.pinged()
 		return nil
 	})
-	tick := time.NewTicker(pingtime)
-	defer tick.Stop()
-
-	// Manage Method/Subscription Ids
-	go func() {
-		for i := uint64(0); ; i++ {
-			i++
-			rock.nextId <- fmt.Sprintf("%d", i)
-		}
-	}()
-
-	// Manage Results map
-	go func() {
-		for {
-			select {
-			case addition := <-rock.resultsAppend:
-				rock.resultsMutex.Lock()
-				rock.results[addition.string] = addition.channel
-				rock.resultsMutex.Unlock()
-			case remove := <-rock.resultsDel:
-				rock.resultsMutex.Lock()
-				delete(rock.results, remove)
-				rock.resultsMutex.Unlock()
-			}
-		}
-	}()
 
 	// Send Thread
 	go func() {
+		tick := time.NewTicker(pingtime)
+		defer tick.Stop()
 		for {
-			msg := <-rock.send
-			packet, err := json.Marshal(msg)
-			err = ws.WriteMessage(websocket.TextMessage, packet)
-			if err != nil {
-				log.WithError(err).WithField("packet", packet).Error("Cannot write to websocket.")
+			select {
+			case msg := <-conn.send:
+				packet, err := json.Marshal(msg)
+				err = ws.WriteMessage(websocket.TextMessage, packet)
+				if err != nil {
+					log.WithError(err).WithField("packet", packet).Error("Cannot write to websocket.")
+					ws.Close()
+					return
+				}
+			case <-tick.C:
+				err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+				if err != nil {
+					log.WithError(err).Error("Cannot ping websocket.")
+					ws.Close()
+					return
+				}
+			case <-conn.done:
 				return
 			}
 		}
@@ -200,7 +450,7 @@ func (rock *RocketCon) run() {
 		ws.SetReadDeadline(time.Now().Add(timeout))
 
 		if err != nil {
-			log.WithError(err).WithField("ws", ws).Warn("Cannot read websocket.")
+			log.WithError(err).WithField("remote", ws.RemoteAddr().String()).Warn("Cannot read websocket.")
 			break
 		}
 
@@ -242,8 +492,12 @@ func (rock *RocketCon) run() {
 					case "inserted":
 						id := obj[1].(map[string]interface{})["rid"].(string)
 						name := obj[1].(map[string]interface{})["name"].(string)
+						t, _ := obj[1].(map[string]interface{})["t"].(string)
+						rock.channelsMutex.Lock()
 						rock.channels[id] = name
-						rock.subscribeRoom(id)
+						rock.roomTypes[id] = t
+						rock.channelsMutex.Unlock()
+						rock.subscribeRoom(conn, id)
 					}
 				case "stream-room-messages":
 					for _, val := range obj {
@@ -266,17 +520,16 @@ func (rock *RocketCon) run() {
 			case "ready":
 				break
 			case "ping":
+				conn.pinged()
 				pong := map[string]string{
 					"msg": "pong",
 				}
-				rock.send <- pong
+				conn.send <- pong
 			default:
 				log.WithField("raw", string(raw)).Trace("Ping.")
 			}
 		}
 	}
-	close(rock.quit)
-	time.Sleep(100 * time.Millisecond) // Ugly hack to make sure rock.quit is closed before we return
 }
 
 func (rock *RocketCon) generateId() string {
@@ -284,7 +537,8 @@ func (rock *RocketCon) generateId() string {
 }
 
 func (rock *RocketCon) watchResults(str string) chan map[string]interface{} {
-	c := make(chan map[string]interface{})
+	// The channel is buffered, so the read thread never blocks on a caller that gave up waiting.
+	c := make(chan map[string]interface{}, 1)
 	rock.resultsAppend <- struct {
 		string  string
 		channel chan map[string]interface{}
@@ -292,7 +546,7 @@ func (rock *RocketCon) watchResults(str string) chan map[string]interface{} {
 	return c
 }
 
-func (rock *RocketCon) subscribeRoom(rid string) {
+func (rock *RocketCon) subscribeRoom(conn *connection, rid string) {
 	subscribeRoom := map[string]interface{}{
 		"msg":  "sub",
 		"id":   rock.generateId(),
@@ -302,11 +556,12 @@ func (rock *RocketCon) subscribeRoom(rid string) {
 			false,
 		},
 	}
-	rock.send <- subscribeRoom
+	conn.send <- subscribeRoom
 }
 
-func (rock *RocketCon) subscribeRooms() error {
-	if rock.UserId == "" {
+func (rock *RocketCon) subscribeRooms(conn *connection) error {
+	userId := rock.OwnUserId()
+	if userId == "" {
 		return errors.New("error: Can't subscribe to rooms if user is not known")
 	}
 	subscriptionMonitor := map[string]interface{}{
@@ -314,11 +569,11 @@ func (rock *RocketCon) subscribeRooms() error {
 		"id":   rock.generateId(),
 		"name": "stream-notify-user",
 		"params": []interface{}{
-			rock.UserId + "/subscriptions-changed",
+			userId + "/subscriptions-changed",
 			false,
 		},
 	}
-	rock.send <- subscriptionMonitor
+	conn.send <- subscriptionMonitor
 
 	subscriptionsGet := map[string]interface{}{
 		"method": "subscriptions/get",
@@ -328,7 +583,7 @@ func (rock *RocketCon) subscribeRooms() error {
 			},
 		},
 	}
-	reply, err := rock.runMethod(subscriptionsGet)
+	reply, err := rock.call(conn, subscriptionsGet)
 	if err != nil {
 		return err
 	}
@@ -336,11 +591,18 @@ func (rock *RocketCon) subscribeRooms() error {
 	objects := reply["result"].(map[string]interface{})["update"].([]interface{})
 
 	for index, _ := range objects {
-		rock.subscribeRoom(objects[index].(map[string]interface{})["rid"].(string))
+		rock.subscribeRoom(conn, objects[index].(map[string]interface{})["rid"].(string))
+		if t, ok := objects[index].(map[string]interface{})["t"].(string); ok {
+			rock.channelsMutex.Lock()
+			rock.roomTypes[objects[index].(map[string]interface{})["rid"].(string)] = t
+			rock.channelsMutex.Unlock()
+		}
 		if _, ok := objects[index].(map[string]interface{})["name"]; ok {
 			name := objects[index].(map[string]interface{})["name"].(string)
 			id := objects[index].(map[string]interface{})["rid"].(string)
+			rock.channelsMutex.Lock()
 			rock.channels[id] = name
+			rock.channelsMutex.Unlock()
 		}
 	}
 	return nil
@@ -361,40 +623,105 @@ func (rock *RocketCon) getWsURL() string {
 }
 
 func (rock *RocketCon) restRequest(str string) []byte {
-	// Define Websocket URL
-	httpURL := rock.getHttpURL() + str
+	body, err := rock.restDo("GET", str, "", nil)
+	if err != nil {
+		log.WithError(err).WithField("path", str).Error("Cannot perform GET request to rocketChat.")
+		return make([]byte, 0)
+	}
+	return body
+}
+
+// restDo sends a request to the REST API with the credentials of the bot, and returns the body of the response.
+func (rock *RocketCon) restDo(method string, path string, contentType string, body io.Reader) ([]byte, error) {
+	httpURL := rock.getHttpURL() + path
 
 	// Build Request
 	client := &http.Client{}
-	request, err := http.NewRequest("GET", httpURL, nil)
+	request, err := http.NewRequest(method, httpURL, body)
 	if err != nil {
-		log.WithError(err).WithField("httpURL", httpURL).Error("Cannot create new GET request to rocketChat.")
-		return make([]byte, 0)
+		return nil, fmt.Errorf("cannot create request: %w", err)
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
 	}
+	rock.authMutex.RLock()
 	request.Header.Set("X-Auth-Token", rock.AuthToken)
 	request.Header.Set("X-User-Id", rock.UserId)
+	rock.authMutex.RUnlock()
 
-	// Get Request
 	response, err := client.Do(request)
 	if err != nil {
-		log.WithError(err).WithField("request", request).Error("Cannot perform GET request to rocketChat.")
-		return make([]byte, 0)
+		return nil, fmt.Errorf("cannot perform request: %w", err)
 	}
+	defer response.Body.Close()
 
-	// Parse Request
-	//defer response.Body.Close()
-	body, _ := io.ReadAll(response.Body)
-	return body
+	return io.ReadAll(response.Body)
 }
 
+// MaxDownloadSize is the size of the largest file Download accepts.
+const MaxDownloadSize = 20 << 20
+
+// Download gets a file uploaded to the server, like the image of an attachment. path is relative to the server
+// (e.g. /file-upload/...), so the credentials of the bot are never sent to other hosts. The content type of the file
+// is returned with its content.
+func (rock *RocketCon) Download(path string) ([]byte, string, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, "", fmt.Errorf("not a path on the server: %s", path)
+	}
+
+	request, err := http.NewRequest("GET", rock.getHttpURL()+path, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot create request: %w", err)
+	}
+	rock.authMutex.RLock()
+	request.Header.Set("X-Auth-Token", rock.AuthToken)
+	request.Header.Set("X-User-Id", rock.UserId)
+	rock.authMutex.RUnlock()
+
+	client := &http.Client{}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot perform request: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("non-OK status code: %d", response.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, MaxDownloadSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot read response body: %w", err)
+	}
+	if len(body) > MaxDownloadSize {
+		return nil, "", fmt.Errorf("the file is larger than %d bytes", MaxDownloadSize)
+	}
+	return body, response.Header.Get("Content-Type"), nil
+}
+
+// runMethod calls a DDP method on the current connection, waiting for a reconnection first if necessary.
 func (rock *RocketCon) runMethod(i map[string]interface{}) (map[string]interface{}, error) {
+	conn, err := rock.readyConnection()
+	if err != nil {
+		return nil, err
+	}
+	return rock.call(conn, i)
+}
+
+func (rock *RocketCon) call(conn *connection, i map[string]interface{}) (map[string]interface{}, error) {
 	id := rock.generateId()
 	i["msg"] = "method"
 	i["id"] = id
 	c := rock.watchResults(id)
-	defer close(c)
-	rock.send <- i
-	reply := <-c
+	conn.send <- i
+
+	var reply map[string]interface{}
+	select {
+	case reply = <-c:
+	case <-conn.done:
+		rock.resultsDel <- id
+		return nil, errors.New("the rocket connection was lost before the method returned")
+	}
+
 	if _, ok := reply["error"]; ok {
 		if _, ok := reply["error"].(map[string]interface{})["error"]; ok {
 			//errNo := reply["error"].(map[string]interface{})["error"].(string)
@@ -408,17 +735,18 @@ func (rock *RocketCon) runMethod(i map[string]interface{}) (map[string]interface
 	return reply, nil
 }
 
-func (rock *RocketCon) connect() {
+func (rock *RocketCon) connect(conn *connection) {
 	init := map[string]interface{}{
 		"msg":     "connect",
 		"version": "1",
 		"support": []string{"1", "pre2", "pre1"},
 	}
-	rock.send <- init
+	conn.send <- init
 }
 
-func (rock *RocketCon) login() error {
+func (rock *RocketCon) login(conn *connection) error {
 	var obj map[string]interface{}
+	rock.authMutex.RLock()
 	if rock.AuthToken == "" {
 		passhash := fmt.Sprintf("%x", sha256.Sum256([]byte(rock.Password)))
 		obj = map[string]interface{}{
@@ -445,13 +773,16 @@ func (rock *RocketCon) login() error {
 			},
 		}
 	}
+	rock.authMutex.RUnlock()
 
-	reply, err := rock.runMethod(obj)
+	reply, err := rock.call(conn, obj)
 	if err != nil {
 		return err
 	}
+	rock.authMutex.Lock()
 	rock.UserId = reply["result"].(map[string]interface{})["id"].(string)
 	rock.AuthToken = reply["result"].(map[string]interface{})["token"].(string)
+	rock.authMutex.Unlock()
 	return nil
 }
 
@@ -463,7 +794,7 @@ func (rock *RocketCon) GetMessage() (Message, error) {
 	case msg := <-rock.newMessages:
 		return msg, nil
 	case <-rock.quit:
-		return msg, errors.New("The rocket connection has been closed")
+		return msg, ErrConnectionClosed
 	}
 }
 
@@ -473,7 +804,7 @@ func (rock *RocketCon) GetNewMessage() (Message, error) {
 	case msg := <-rock.newMessages:
 		return msg, nil
 	case <-rock.quit:
-		return msg, errors.New("The rocket connection has been closed")
+		return msg, ErrConnectionClosed
 	}
 }
 
@@ -497,6 +828,8 @@ func (rock *RocketCon) RefreshChannelCache() error {
 	if err != nil {
 		return err
 	}
+	rock.channelsMutex.Lock()
+	defer rock.channelsMutex.Unlock()
 	for _, val := range reply["result"].([]interface{}) {
 		if _, ok := val.(map[string]interface{})["fname"]; ok {
 			name := val.(map[string]interface{})["fname"].(string)
@@ -508,7 +841,7 @@ func (rock *RocketCon) RefreshChannelCache() error {
 }
 
 func (rock *RocketCon) requestMessageObj(mid string) map[string]interface{} {
-	resp := rock.restRequest("/api/v1/chat.getMessage?msgId=" + mid)
+	resp := rock.restRequest("/api/v1/chat.getMessage?msgId=" + url.QueryEscape(mid))
 	var m map[string]interface{}
 	err := json.Unmarshal(resp, &m)
 	if err != nil {
@@ -533,29 +866,116 @@ func (rock *RocketCon) RequestDisplayName(uid string) (string, error) {
 	return "", errors.New("Some error")
 }
 
+// RequestMessage fetches the message mid. It returns ErrMessageNotFound if the message does not exist or the bot
+// cannot see it.
 func (rock *RocketCon) RequestMessage(mid string) (Message, error) {
-	var msg Message
 	obj := rock.requestMessageObj(mid)
-	if _, ok := obj["message"]; ok {
-		msg = rock.handleMessageObject(obj["message"].(map[string]interface{}))
-		return msg, nil
+	message, ok := obj["message"].(map[string]interface{})
+	if !ok {
+		return Message{}, ErrMessageNotFound
+	}
+	return rock.parseRESTMessage(message)
+}
+
+// historyEndpoints are the REST endpoints of the history of the room types.
+var historyEndpoints = map[string]string{
+	"c": "channels.history",
+	"p": "groups.history",
+	"d": "im.history",
+}
+
+// RoomHistory returns the messages of the room rid, newest first: at most count of them (0 means no limit), and
+// none older than oldest (the zero time means no limit). The system messages (e.g. someone joined) are left out.
+func (rock *RocketCon) RoomHistory(rid string, count int, oldest time.Time) ([]Message, error) {
+	const pageSize = 100
+
+	rock.channelsMutex.RLock()
+	roomType := rock.roomTypes[rid]
+	rock.channelsMutex.RUnlock()
+	endpoint, ok := historyEndpoints[roomType]
+	if !ok {
+		return nil, fmt.Errorf("unknown type of room %s: %q", rid, roomType)
+	}
+
+	var messages []Message
+	latest := ""
+	for {
+		query := url.Values{}
+		query.Set("roomId", rid)
+		query.Set("count", strconv.Itoa(pageSize))
+		if latest != "" {
+			// The next page starts before the oldest message of the previous one.
+			query.Set("latest", latest)
+		}
+		if !oldest.IsZero() {
+			query.Set("oldest", oldest.UTC().Format("2006-01-02T15:04:05.000Z"))
+		}
+		body, err := rock.restDo("GET", "/api/v1/"+endpoint+"?"+query.Encode(), "", nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var resp struct {
+			Messages []map[string]interface{} `json:"messages"`
+			Success  bool                     `json:"success"`
+			Error    string                   `json:"error"`
+		}
+		err = json.Unmarshal(body, &resp)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %s response: %w", endpoint, err)
+		}
+		if !resp.Success {
+			return nil, fmt.Errorf("%s failed: %s", endpoint, resp.Error)
+		}
+
+		for _, obj := range resp.Messages {
+			if ts, ok := obj["ts"].(string); ok {
+				latest = ts
+			}
+			if _, system := obj["t"]; system {
+				continue
+			}
+			// The history is not a new message, so it is parsed without touching the state of the stream.
+			msg, err := rock.parseRESTMessage(obj)
+			if err != nil {
+				log.WithError(err).WithField("room", rid).Warn("Skipping message of the history.")
+				continue
+			}
+			messages = append(messages, msg)
+			if count > 0 && len(messages) >= count {
+				return messages, nil
+			}
+		}
+		if len(resp.Messages) < pageSize || latest == "" {
+			return messages, nil
+		}
 	}
-	return msg, errors.New("Some error")
 }
 
 func (rock *RocketCon) SendMessage(rid string, text string) (Message, error) {
+	return rock.SendThreadMessage(rid, "", text)
+}
+
+// SendThreadMessage sends text to the thread tmid of the room rid. If tmid is empty, it is sent to the main timeline.
+func (rock *RocketCon) SendThreadMessage(rid string, tmid string, text string) (Message, error) {
+	message := map[string]interface{}{
+		"rid": rid,
+		"msg": text,
+	}
+	if tmid != "" {
+		message["tmid"] = tmid
+	}
 	obj := map[string]interface{}{
 		"method": "sendMessage",
 		"params": []map[string]interface{}{
-			map[string]interface{}{
-				"rid": rid,
-				"msg": text,
-			},
+			message,
 		},
 	}
 
 	var msg Message
+	start := time.Now()
 	reply, err := rock.runMethod(obj)
+	metrics.Since(metrics.OperationSendMessage, start)
 	if err != nil {
 		return msg, err
 	}
@@ -566,6 +986,45 @@ func (rock *RocketCon) SendMessage(rid string, text string) (Message, error) {
 	return msg, nil
 }
 
+// UploadFile posts a file to the room rid, in the thread tmid if it is not empty. text is shown with the file.
+func (rock *RocketCon) UploadFile(rid string, tmid string, fileName string, data []byte, text string) error {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	file, err := form.CreateFormFile("file", fileName)
+	if err == nil {
+		_, err = file.Write(data)
+	}
+	if err == nil && text != "" {
+		err = form.WriteField("msg", text)
+	}
+	if err == nil && tmid != "" {
+		err = form.WriteField("tmid", tmid)
+	}
+	if err == nil {
+		err = form.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot assemble request body: %w", err)
+	}
+
+	reply, err := rock.restDo("POST", "/api/v1/rooms.upload/"+url.PathEscape(rid), form.FormDataContentType(), &body)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	err = json.Unmarshal(reply, &resp)
+	if err != nil {
+		return fmt.Errorf("cannot parse response: %w", err)
+	}
+	if !resp.Success {
+		return fmt.Errorf("upload failed: %s", resp.Error)
+	}
+	return nil
+}
+
 func (rock *RocketCon) DM(username string, text string) (Message, error) {
 	obj := map[string]interface{}{
 		"method": "createDirectMessage",
@@ -607,7 +1066,12 @@ func (rock *RocketCon) UserDefaultStatus(status string) error {
 	return err
 }
 
+// UserTemporaryStatus sets the status of the bot for the session. It is set again after reconnecting.
 func (rock *RocketCon) UserTemporaryStatus(status string) error {
+	rock.authMutex.Lock()
+	rock.status = status
+	rock.authMutex.Unlock()
+
 	reaction := map[string]interface{}{
 		"method": "UserPresence:" + status,
 		"params": []string{},
@@ -658,12 +1122,14 @@ func (rock *RocketCon) ListUsersInRoomId(roomId string) ([]string, error) {
 
 func (rock *RocketCon) ListUsersInRoom(room string) ([]string, error) {
 	roomId := ""
+	rock.channelsMutex.RLock()
 	for id, name := range rock.channels {
 		if room == name {
 			roomId = id
 			break
 		}
 	}
+	rock.channelsMutex.RUnlock()
 	if roomId == "" {
 		return make([]string, 0), errors.New("No Known Room")
 	}
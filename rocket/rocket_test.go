@@ -0,0 +1,253 @@
+package rocket
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/rocket/rockettest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var bot = rockettest.User{ID: "bot-id", UserName: "bartender", Name: "Bartender", Password: "secret"}
+
+var general = rockettest.Room{ID: "r1", Name: "general", Type: "c", Members: []string{"bartender", "alice", "bob"}}
+
+var direct = rockettest.Room{ID: "d1", Name: "alice", Type: "d"}
+
+func connect(t *testing.T, server *rockettest.Server) *RocketCon {
+	rock, err := NewConnectionFromConfig(server.Config())
+	require.NoError(t, err)
+	t.Cleanup(rock.Close)
+	return rock
+}
+
+func TestLogin(t *testing.T) {
+	server := rockettest.NewServer(bot)
+	defer server.Close()
+
+	rock := connect(t, server)
+	assert.Equal(t, "bot-id", rock.UserId)
+	assert.Equal(t, "token-bot-id", rock.AuthToken)
+	assert.Equal(t, "Bartender", rock.DisplayName)
+	status := rock.Status()
+	assert.True(t, status.Connected)
+	assert.True(t, status.LoggedIn)
+
+	logins := server.Calls("login")
+	require.Len(t, logins, 1)
+	assert.Equal(t, map[string]interface{}{
+		"user":     map[string]interface{}{"username": "bartender"},
+		"password": map[string]interface{}{"digest": fmt.Sprintf("%x", sha256.Sum256([]byte("secret"))), "algorithm": "sha-256"},
+	}, logins[0].Params[0])
+
+	cfg := server.Config()
+	cfg.RocketChat.Password = "wrong"
+	_, err := NewConnectionFromConfig(cfg)
+	assert.Error(t, err)
+}
+
+func TestLoginResumeFallback(t *testing.T) {
+	server := rockettest.NewServer(bot)
+	defer server.Close()
+
+	// An expired resume token is replaced by logging in with the password.
+	cfg := server.Config()
+	cfg.RocketChat.AuthToken = "expired"
+	rock, err := NewConnectionFromConfig(cfg)
+	require.NoError(t, err)
+	defer rock.Close()
+
+	assert.Equal(t, "token-bot-id", rock.AuthToken)
+	logins := server.Calls("login")
+	require.Len(t, logins, 2)
+	assert.Equal(t, map[string]interface{}{"resume": "expired"}, logins[0].Params[0])
+}
+
+func TestSubscribeRooms(t *testing.T) {
+	server := rockettest.NewServer(bot, general, direct)
+	defer server.Close()
+
+	rock := connect(t, server)
+	assert.NoError(t, server.WaitSubscribed("r1"))
+	assert.NoError(t, server.WaitSubscribed("d1"))
+	assert.NotEmpty(t, server.Calls("subscriptions/get"))
+
+	// Rooms the bot is invited to later are subscribed too.
+	server.AddRoom(rockettest.Room{ID: "r2", Name: "random", Type: "c"})
+	assert.NoError(t, server.WaitSubscribed("r2"))
+
+	users, err := rock.ListUsersInRoom("general")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bartender", "alice", "bob"}, users)
+}
+
+func TestMessages(t *testing.T) {
+	server := rockettest.NewServer(bot, general, direct)
+	defer server.Close()
+
+	rock := connect(t, server)
+	require.NoError(t, server.WaitSubscribed("r1"))
+	require.NoError(t, server.WaitSubscribed("d1"))
+
+	posted := server.Post(rockettest.Message{RoomID: "r1", UserID: "u1", UserName: "alice", Text: "@bartender how are you?"})
+	msg, err := rock.GetNewMessage()
+	require.NoError(t, err)
+	assert.Equal(t, posted.ID, msg.Id)
+	assert.Equal(t, "general", msg.RoomName)
+	assert.Equal(t, "alice", msg.UserName)
+	assert.True(t, msg.AmIPinged)
+	assert.True(t, msg.IsMention)
+	assert.False(t, msg.IsDirect)
+	assert.Equal(t, "how are you?", msg.GetNotAddressedText())
+
+	// Only the mention is stripped, the case of the rest is kept.
+	server.Post(rockettest.Message{RoomID: "r1", UserID: "u1", UserName: "alice", Text: "@Bartender !image A Cat named Tom"})
+	msg, err = rock.GetNewMessage()
+	require.NoError(t, err)
+	assert.True(t, msg.AmIPinged)
+	assert.Equal(t, "!image A Cat named Tom", msg.GetNotAddressedText())
+
+	server.Post(rockettest.Message{
+		RoomID:   "d1",
+		ThreadID: "m0",
+		UserID:   "u1",
+		UserName: "alice",
+		Attachments: []map[string]interface{}{{
+			"description": "What is this?",
+			"image_url":   "/file-upload/f1/cat.png",
+			"image_type":  "image/png",
+		}},
+	})
+	msg, err = rock.GetNewMessage()
+	require.NoError(t, err)
+	assert.True(t, msg.IsDirect)
+	assert.Equal(t, "m0", msg.ThreadId)
+	assert.Equal(t, "What is this?", msg.Text)
+	require.Len(t, msg.Attachments, 1)
+	assert.True(t, msg.Attachments[0].IsImage())
+
+	// The replies stay in the thread, and the reply of the bot is not a new message for itself.
+	reply, err := msg.Reply("A cat.")
+	require.NoError(t, err)
+	assert.True(t, reply.IsMe)
+	sent, err := server.WaitSent(1)
+	require.NoError(t, err)
+	assert.Equal(t, "d1", sent[0].RoomID)
+	assert.Equal(t, "m0", sent[0].ThreadID)
+	assert.Equal(t, "A cat.", sent[0].Text)
+
+	assert.NoError(t, reply.EditText("A cat, sleeping."))
+	assert.Equal(t, "A cat, sleeping.", server.Sent()[0].Text)
+	assert.True(t, server.Sent()[0].Edited)
+}
+
+func TestRequestMessage(t *testing.T) {
+	server := rockettest.NewServer(bot, general)
+	defer server.Close()
+
+	rock := connect(t, server)
+	require.NoError(t, server.WaitSubscribed("r1"))
+
+	posted := server.Post(rockettest.Message{RoomID: "r1", UserID: "u1", UserName: "alice", Text: "Cheers!"})
+	msg, err := rock.RequestMessage(posted.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "r1", msg.RoomId)
+	assert.Equal(t, "general", msg.RoomName)
+	assert.Equal(t, "alice", msg.UserName)
+	assert.Equal(t, "Cheers!", msg.Text)
+
+	_, err = rock.RequestMessage("missing&msgId=" + posted.ID)
+	assert.ErrorIs(t, err, ErrMessageNotFound)
+}
+
+func TestParseRESTMessage(t *testing.T) {
+	rock := &RocketCon{channels: map[string]string{}}
+	msg, err := rock.parseRESTMessage(map[string]interface{}{
+		"_id": "m1",
+		"rid": "r1",
+		"msg": 42,
+		"u":   "alice",
+		"ts":  map[string]interface{}{"$date": 1700000000123.0},
+	})
+	require.NoError(t, err, "the malformed fields are left empty")
+	assert.Equal(t, "", msg.Text)
+	assert.Equal(t, "", msg.UserName)
+	assert.Equal(t, time.UnixMilli(1700000000123), msg.Timestamp)
+
+	_, err = rock.parseRESTMessage(map[string]interface{}{"_id": []interface{}{}})
+	assert.Error(t, err)
+}
+
+func TestRoomHistory(t *testing.T) {
+	server := rockettest.NewServer(bot, general)
+	defer server.Close()
+
+	rock := connect(t, server)
+	require.NoError(t, server.WaitSubscribed("r1"))
+	server.Post(rockettest.Message{RoomID: "r1", UserID: "u2", UserName: "bob", Type: "uj"})
+	var posted []rockettest.Message
+	for i := 0; i < 3; i++ {
+		posted = append(posted, server.Post(rockettest.Message{RoomID: "r1", UserID: "u1", UserName: "alice", Text: fmt.Sprintf("message %d", i)}))
+	}
+	// Wait until the stream has seen every message.
+	for {
+		msg, err := rock.GetNewMessage()
+		require.NoError(t, err)
+		if msg.Text == "message 2" {
+			break
+		}
+	}
+
+	// Reading the history must not move the time of the last new message, or the messages arriving meanwhile
+	// would be dropped as old.
+	lastMessageTimeMutex.Lock()
+	saved := lastMessageTime
+	lastMessageTime = posted[0].Timestamp.Add(-time.Hour)
+	mark := lastMessageTime
+	lastMessageTimeMutex.Unlock()
+	defer func() {
+		lastMessageTimeMutex.Lock()
+		lastMessageTime = saved
+		lastMessageTimeMutex.Unlock()
+	}()
+
+	messages, err := rock.RoomHistory("r1", 2, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	assert.Equal(t, "message 2", messages[0].Text)
+	assert.Equal(t, "message 1", messages[1].Text)
+	assert.True(t, posted[2].Timestamp.Equal(messages[0].Timestamp))
+	assert.Equal(t, "general", messages[0].RoomName)
+
+	lastMessageTimeMutex.Lock()
+	assert.Equal(t, mark, lastMessageTime)
+	lastMessageTimeMutex.Unlock()
+}
+
+func TestReconnect(t *testing.T) {
+	server := rockettest.NewServer(bot, general)
+	defer server.Close()
+
+	rock := connect(t, server)
+	require.NoError(t, server.WaitSubscribed("r1"))
+	require.NoError(t, rock.UserTemporaryStatus(STATUS_ONLINE))
+
+	server.Disconnect()
+	_, err := server.WaitCalls("login", 2)
+	require.NoError(t, err)
+	require.NoError(t, server.WaitSubscribed("r1"))
+	// The bot does not show as offline after the reconnect.
+	_, err = server.WaitCalls("UserPresence:"+STATUS_ONLINE, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "bot-id", rock.OwnUserId())
+
+	// Messages sent while reconnecting wait for the new connection.
+	_, err = rock.SendMessage("r1", "I'm back.")
+	require.NoError(t, err)
+	sent := server.Sent()
+	require.Len(t, sent, 1)
+	assert.Equal(t, "I'm back.", sent[0].Text)
+}
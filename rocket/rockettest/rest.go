@@ -0,0 +1,191 @@
+package rockettest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/websocket", s.serveWebsocket)
+	mux.HandleFunc("/api/v1/users.info", s.authorized(s.usersInfo))
+	mux.HandleFunc("/api/v1/chat.getMessage", s.authorized(s.chatGetMessage))
+	mux.HandleFunc("/api/v1/channels.members", s.authorized(s.channelsMembers))
+	mux.HandleFunc("/api/v1/channels.history", s.authorized(s.history("c")))
+	mux.HandleFunc("/api/v1/groups.history", s.authorized(s.history("p")))
+	mux.HandleFunc("/api/v1/im.history", s.authorized(s.history("d")))
+	mux.HandleFunc("/api/v1/rooms.upload/", s.authorized(s.roomsUpload))
+	mux.HandleFunc("/", s.authorized(s.serveFile))
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{"success": false, "error": message})
+}
+
+// authorized rejects the requests without the credentials of the bot.
+func (s *Server) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		user := s.user
+		s.mutex.Unlock()
+
+		if r.Header.Get("X-Auth-Token") != user.AuthToken || r.Header.Get("X-User-Id") != user.ID {
+			writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+				"status":  "error",
+				"message": "You must be logged in to do this.",
+			})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (s *Server) usersInfo(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	user := s.user
+	s.mutex.Unlock()
+
+	if r.URL.Query().Get("userId") != user.ID {
+		writeError(w, http.StatusBadRequest, "User not found.")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user": map[string]interface{}{
+			"_id":      user.ID,
+			"username": user.UserName,
+			"name":     user.Name,
+		},
+		"success": true,
+	})
+}
+
+func (s *Server) chatGetMessage(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	i, ok := s.message(r.URL.Query().Get("msgId"))
+	var msg Message
+	if ok {
+		msg = s.messages[i]
+	}
+	s.mutex.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Message not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": msg.object(), "success": true})
+}
+
+func (s *Server) channelsMembers(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	room, ok := s.room(r.URL.Query().Get("roomId"))
+	s.mutex.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusBadRequest, "The required \"roomId\" or \"roomName\" param provided does not match any channel [error-room-not-found]")
+		return
+	}
+	members := []interface{}{}
+	for _, username := range room.Members {
+		members = append(members, map[string]interface{}{"_id": "u-" + username, "username": username})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"members": members, "success": true})
+}
+
+// history serves the history endpoint of the rooms of roomType: the messages between oldest and latest, newest first.
+func (s *Server) history(roomType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		count := 20
+		if value := query.Get("count"); value != "" {
+			count, _ = strconv.Atoi(value)
+		}
+		var latest, oldest time.Time
+		if value := query.Get("latest"); value != "" {
+			latest, _ = time.Parse(time.RFC3339Nano, value)
+		}
+		if value := query.Get("oldest"); value != "" {
+			oldest, _ = time.Parse(time.RFC3339Nano, value)
+		}
+
+		s.mutex.Lock()
+		room, ok := s.room(query.Get("roomId"))
+		messages := []interface{}{}
+		for i := len(s.messages) - 1; i >= 0 && ok && len(messages) < count; i-- {
+			msg := s.messages[i]
+			if msg.RoomID != room.ID ||
+				!latest.IsZero() && !msg.Timestamp.Before(latest) ||
+				!oldest.IsZero() && !msg.Timestamp.After(oldest) {
+				continue
+			}
+			messages = append(messages, msg.object())
+		}
+		s.mutex.Unlock()
+
+		if !ok || room.Type != roomType {
+			writeError(w, http.StatusBadRequest, "The required \"roomId\" or \"roomName\" param provided does not match any room [error-room-not-found]")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"messages": messages, "success": true})
+	}
+}
+
+func (s *Server) roomsUpload(w http.ResponseWriter, r *http.Request) {
+	rid := strings.TrimPrefix(r.URL.Path, "/api/v1/rooms.upload/")
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	formFile, header, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "[invalid-field]")
+		return
+	}
+	defer formFile.Close()
+	data, err := io.ReadAll(formFile)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.room(rid); !ok {
+		writeError(w, http.StatusBadRequest, "error-not-allowed")
+		return
+	}
+	s.uploads = append(s.uploads, Upload{
+		RoomID:   rid,
+		ThreadID: r.FormValue("tmid"),
+		FileName: header.Filename,
+		Data:     data,
+		Text:     r.FormValue("msg"),
+	})
+	s.notify()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// serveFile serves the files added with AddFile.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	f, ok := s.files[r.URL.Path]
+	s.mutex.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", f.contentType)
+	w.Write(f.data)
+}
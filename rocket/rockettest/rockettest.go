@@ -0,0 +1,672 @@
+// Package rockettest is an in-process fake of the Rocket.Chat server for tests. It speaks the DDP protocol on the
+// /websocket endpoint and serves the REST endpoints used by the rocket package. Logins, subscriptions, incoming
+// messages and method results can be scripted, and everything the client sends is recorded.
+package rockettest
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+
+	"github.com/gorilla/websocket"
+)
+
+// Timeout is how long the Wait methods wait for the client.
+const Timeout = 5 * time.Second
+
+// timeLayout is the format of the timestamps in the messages, as parsed by the rocket package.
+const timeLayout = "2006-01-02T15:04:05.999999999Z"
+
+// User is the account of the bot on the fake server.
+type User struct {
+	ID        string
+	UserName  string
+	Name      string // The display name.
+	Password  string
+	AuthToken string // The resume token returned by the logins. Generated if empty.
+}
+
+// Room is a room the bot is subscribed to.
+type Room struct {
+	ID      string
+	Name    string // The name of the channel, or the username of the other user in direct messages.
+	Type    string // c: channel, p: private group, d: direct messages.
+	Members []string
+}
+
+// Message is a message of a room.
+type Message struct {
+	ID          string
+	RoomID      string
+	ThreadID    string
+	UserID      string
+	UserName    string
+	Text        string
+	Type        string // The type of system messages (e.g. uj when a user joined), empty for normal messages.
+	Timestamp   time.Time
+	Edited      bool
+	Attachments []map[string]interface{}
+}
+
+// Call is a DDP method call made by the client.
+type Call struct {
+	Method string
+	Params []interface{}
+}
+
+// Subscription is a DDP subscription made by the client.
+type Subscription struct {
+	Name   string
+	Params []interface{}
+}
+
+// Upload is a file posted to rooms.upload.
+type Upload struct {
+	RoomID   string
+	ThreadID string
+	FileName string
+	Data     []byte
+	Text     string
+}
+
+// Error is the error result of a method. Handlers can return it to control what the client receives; other errors
+// are sent as a 500 Meteor.Error.
+type Error struct {
+	Code   int
+	Type   string
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s [%d]", e.Reason, e.Code)
+}
+
+// MethodHandler answers a method call. The result is sent to the client as JSON.
+type MethodHandler func(params []interface{}) (interface{}, error)
+
+type file struct {
+	contentType string
+	data        []byte
+}
+
+// Server is a fake Rocket.Chat server listening on a local port.
+type Server struct {
+	http *httptest.Server
+
+	mutex         sync.Mutex
+	user          User
+	rooms         []Room
+	methods       map[string]MethodHandler
+	conns         map[*conn]struct{}
+	calls         []Call
+	subscriptions []Subscription
+	messages      []Message
+	uploads       []Upload
+	files         map[string]file
+	lastTimestamp time.Time
+	nextId        int
+	changed       chan struct{} // Closed and replaced whenever something is recorded.
+}
+
+// conn is a websocket client of the server.
+type conn struct {
+	ws         *websocket.Conn
+	writeMutex sync.Mutex
+	rooms      map[string]bool // The rooms subscribed with stream-room-messages.
+}
+
+func (c *conn) write(packet interface{}) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.ws.WriteJSON(packet)
+}
+
+// NewServer starts a fake server with the account of the bot and the rooms it is subscribed to. It is stopped by
+// Close.
+func NewServer(user User, rooms ...Room) *Server {
+	if user.AuthToken == "" {
+		user.AuthToken = "token-" + user.ID
+	}
+	s := &Server{
+		user:    user,
+		rooms:   rooms,
+		conns:   make(map[*conn]struct{}),
+		files:   make(map[string]file),
+		changed: make(chan struct{}),
+	}
+	s.methods = map[string]MethodHandler{
+		"login":               s.login,
+		"subscriptions/get":   s.subscriptionsGet,
+		"rooms/get":           s.roomsGet,
+		"sendMessage":         s.sendMessage,
+		"updateMessage":       s.updateMessage,
+		"deleteMessage":       s.deleteMessage,
+		"createDirectMessage": s.createDirectMessage,
+	}
+	s.http = httptest.NewServer(s.handler())
+	return s
+}
+
+// Close disconnects the clients and stops the server.
+func (s *Server) Close() {
+	s.Disconnect()
+	s.http.Close()
+}
+
+// URL is the base URL of the server, e.g. http://127.0.0.1:12345.
+func (s *Server) URL() string {
+	return s.http.URL
+}
+
+// Config returns a configuration that connects to the server with the password of the bot.
+func (s *Server) Config() *config.Config {
+	host, port, _ := net.SplitHostPort(s.http.Listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+
+	cfg := &config.Config{}
+	cfg.RocketChat.HostName = host
+	cfg.RocketChat.Port = uint16(portNumber)
+	cfg.RocketChat.SSL = false
+	cfg.RocketChat.User = s.user.UserName
+	cfg.RocketChat.Password = s.user.Password
+	return cfg
+}
+
+// HandleMethod sets the handler of a method, replacing the built-in one. Methods without a handler return null.
+func (s *Server) HandleMethod(method string, handler MethodHandler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.methods[method] = handler
+}
+
+// AddRoom subscribes the bot to a new room, and notifies the connected clients like Rocket.Chat does when the bot
+// is invited.
+func (s *Server) AddRoom(room Room) {
+	s.mutex.Lock()
+	s.rooms = append(s.rooms, room)
+	s.mutex.Unlock()
+
+	s.broadcast(func(c *conn) bool { return true }, map[string]interface{}{
+		"msg":        "changed",
+		"collection": "stream-notify-user",
+		"id":         "id",
+		"fields": map[string]interface{}{
+			"eventName": s.user.ID + "/subscriptions-changed",
+			"args": []interface{}{
+				"inserted",
+				map[string]interface{}{"rid": room.ID, "name": room.Name, "t": room.Type},
+			},
+		},
+	})
+}
+
+// AddFile serves data at path (e.g. /file-upload/abc/cat.png) to the logged in clients.
+func (s *Server) AddFile(path string, contentType string, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.files[path] = file{contentType: contentType, data: data}
+}
+
+// Post adds msg to its room and sends it to the clients subscribed to the room. The id and the timestamp are set if
+// they are empty. The message is returned as it was posted.
+func (s *Server) Post(msg Message) Message {
+	s.mutex.Lock()
+	msg = s.store(msg)
+	s.mutex.Unlock()
+
+	s.broadcastMessage(msg)
+	return msg
+}
+
+// Disconnect closes the websocket of every client, as if the server restarted.
+func (s *Server) Disconnect() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c := range s.conns {
+		c.ws.Close()
+	}
+}
+
+// Calls returns the method calls made by the clients. If method is not empty, only the calls of that method are
+// returned.
+func (s *Server) Calls(method string) []Call {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.callsOf(method)
+}
+
+// Subscriptions returns the subscriptions made by the clients.
+func (s *Server) Subscriptions() []Subscription {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Subscription(nil), s.subscriptions...)
+}
+
+// Sent returns the messages sent by the bot, with their edits applied.
+func (s *Server) Sent() []Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sent()
+}
+
+// Uploads returns the files uploaded by the bot.
+func (s *Server) Uploads() []Upload {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Upload(nil), s.uploads...)
+}
+
+// WaitCalls waits until at least n calls of method are made, and returns them.
+func (s *Server) WaitCalls(method string, n int) ([]Call, error) {
+	var calls []Call
+	err := s.wait(fmt.Sprintf("%d calls of %s", n, method), func() bool {
+		calls = s.callsOf(method)
+		return len(calls) >= n
+	})
+	return calls, err
+}
+
+// WaitSubscribed waits until a client subscribes to the messages of the room rid.
+func (s *Server) WaitSubscribed(rid string) error {
+	return s.wait("subscription to "+rid, func() bool {
+		for c := range s.conns {
+			if c.rooms[rid] {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// WaitSent waits until the bot sends at least n messages, and returns them.
+func (s *Server) WaitSent(n int) ([]Message, error) {
+	var messages []Message
+	err := s.wait(fmt.Sprintf("%d sent messages", n), func() bool {
+		messages = s.sent()
+		return len(messages) >= n
+	})
+	return messages, err
+}
+
+// wait blocks until cond, called with the mutex held, returns true or Timeout passes.
+func (s *Server) wait(what string, cond func() bool) error {
+	deadline := time.After(Timeout)
+	for {
+		s.mutex.Lock()
+		ok, changed := cond(), s.changed
+		s.mutex.Unlock()
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return fmt.Errorf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// notify wakes up the waiting goroutines. The mutex must be held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) callsOf(method string) []Call {
+	var calls []Call
+	for _, call := range s.calls {
+		if method == "" || call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func (s *Server) sent() []Message {
+	var messages []Message
+	for _, msg := range s.messages {
+		if msg.UserID == s.user.ID {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+func (s *Server) generateId(prefix string) string {
+	s.nextId++
+	return fmt.Sprintf("%s%d", prefix, s.nextId)
+}
+
+// store fills the missing fields of msg and adds it to the messages. The mutex must be held.
+func (s *Server) store(msg Message) Message {
+	if msg.ID == "" {
+		msg.ID = s.generateId("m")
+	}
+	if msg.Timestamp.IsZero() {
+		// The client drops messages that are not newer than the last one, so the timestamps are kept increasing.
+		msg.Timestamp = time.Now().UTC()
+		if !msg.Timestamp.After(s.lastTimestamp) {
+			msg.Timestamp = s.lastTimestamp.Add(time.Microsecond)
+		}
+		s.lastTimestamp = msg.Timestamp
+	}
+	s.messages = append(s.messages, msg)
+	s.notify()
+	return msg
+}
+
+func (s *Server) message(id string) (int, bool) {
+	for i, msg := range s.messages {
+		if msg.ID == id {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (s *Server) room(rid string) (Room, bool) {
+	for _, room := range s.rooms {
+		if room.ID == rid {
+			return room, true
+		}
+	}
+	return Room{}, false
+}
+
+// object returns msg in the format of the Rocket.Chat API.
+func (msg Message) object() map[string]interface{} {
+	ts := msg.Timestamp.UTC().Format(timeLayout)
+	obj := map[string]interface{}{
+		"_id":        msg.ID,
+		"rid":        msg.RoomID,
+		"msg":        msg.Text,
+		"ts":         ts,
+		"_updatedAt": ts,
+		"u": map[string]interface{}{
+			"_id":      msg.UserID,
+			"username": msg.UserName,
+		},
+	}
+	if msg.ThreadID != "" {
+		obj["tmid"] = msg.ThreadID
+	}
+	if msg.Type != "" {
+		obj["t"] = msg.Type
+	}
+	if msg.Edited {
+		obj["editedAt"] = ts
+	}
+	if msg.Attachments != nil {
+		obj["attachments"] = msg.Attachments
+	}
+	return obj
+}
+
+func (s *Server) broadcastMessage(msg Message) {
+	s.broadcast(func(c *conn) bool { return c.rooms[msg.RoomID] }, map[string]interface{}{
+		"msg":        "changed",
+		"collection": "stream-room-messages",
+		"id":         "id",
+		"fields": map[string]interface{}{
+			"eventName": msg.RoomID,
+			"args":      []interface{}{msg.object()},
+		},
+	})
+}
+
+// broadcast sends packet to the clients selected by to.
+func (s *Server) broadcast(to func(c *conn) bool, packet interface{}) {
+	s.mutex.Lock()
+	var conns []*conn
+	for c := range s.conns {
+		if to(c) {
+			conns = append(conns, c)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, c := range conns {
+		c.write(packet)
+	}
+}
+
+var upgrader = websocket.Upgrader{}
+
+// serveWebsocket speaks DDP with a client.
+func (s *Server) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &conn{ws: ws, rooms: make(map[string]bool)}
+	s.mutex.Lock()
+	s.conns[c] = struct{}{}
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, c)
+		s.notify()
+		s.mutex.Unlock()
+		ws.Close()
+	}()
+
+	for {
+		var packet struct {
+			Msg    string        `json:"msg"`
+			ID     string        `json:"id"`
+			Method string        `json:"method"`
+			Name   string        `json:"name"`
+			Params []interface{} `json:"params"`
+		}
+		_, raw, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if json.Unmarshal(raw, &packet) != nil {
+			continue
+		}
+
+		switch packet.Msg {
+		case "connect":
+			err = c.write(map[string]interface{}{"msg": "connected", "session": s.session()})
+		case "method":
+			err = c.write(s.call(packet.ID, packet.Method, packet.Params))
+		case "sub":
+			s.mutex.Lock()
+			s.subscriptions = append(s.subscriptions, Subscription{Name: packet.Name, Params: packet.Params})
+			if packet.Name == "stream-room-messages" && len(packet.Params) > 0 {
+				if rid, ok := packet.Params[0].(string); ok {
+					c.rooms[rid] = true
+				}
+			}
+			s.notify()
+			s.mutex.Unlock()
+			err = c.write(map[string]interface{}{"msg": "ready", "subs": []string{packet.ID}})
+		case "ping":
+			err = c.write(map[string]interface{}{"msg": "pong"})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) session() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.generateId("session")
+}
+
+// call records a method call and returns the packet of its result.
+func (s *Server) call(id string, method string, params []interface{}) map[string]interface{} {
+	s.mutex.Lock()
+	s.calls = append(s.calls, Call{Method: method, Params: params})
+	s.notify()
+	handler := s.methods[method]
+	s.mutex.Unlock()
+
+	reply := map[string]interface{}{"msg": "result", "id": id}
+	if handler == nil {
+		reply["result"] = nil
+		return reply
+	}
+	result, err := handler(params)
+	if err != nil {
+		var methodErr *Error
+		if !errors.As(err, &methodErr) {
+			methodErr = &Error{Code: 500, Type: "Meteor.Error", Reason: err.Error()}
+		}
+		reply["error"] = map[string]interface{}{
+			"isClientSafe": true,
+			"error":        methodErr.Code,
+			"reason":       methodErr.Reason,
+			"message":      methodErr.Error(),
+			"errorType":    methodErr.Type,
+		}
+		return reply
+	}
+	reply["result"] = result
+	return reply
+}
+
+// param returns the first parameter of a method call as an object.
+func param(params []interface{}) map[string]interface{} {
+	if len(params) == 0 {
+		return nil
+	}
+	obj, _ := params[0].(map[string]interface{})
+	return obj
+}
+
+// login accepts the resume token or the username and the SHA-256 digest of the password of the bot.
+func (s *Server) login(params []interface{}) (interface{}, error) {
+	s.mutex.Lock()
+	user := s.user
+	s.mutex.Unlock()
+
+	obj := param(params)
+	ok := false
+	if resume, isResume := obj["resume"].(string); isResume {
+		ok = resume == user.AuthToken
+	} else {
+		userObj, _ := obj["user"].(map[string]interface{})
+		passwordObj, _ := obj["password"].(map[string]interface{})
+		digest := fmt.Sprintf("%x", sha256.Sum256([]byte(user.Password)))
+		ok = userObj["username"] == user.UserName && passwordObj["digest"] == digest && user.Password != ""
+	}
+	if !ok {
+		return nil, &Error{Code: 403, Type: "Meteor.Error", Reason: "User not found"}
+	}
+	return map[string]interface{}{
+		"id":           user.ID,
+		"token":        user.AuthToken,
+		"tokenExpires": map[string]interface{}{"$date": time.Now().Add(90*24*time.Hour).UnixNano() / 1e6},
+		"type":         "password",
+	}, nil
+}
+
+func (s *Server) subscriptionsGet(params []interface{}) (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	update := []interface{}{}
+	for _, room := range s.rooms {
+		update = append(update, map[string]interface{}{"rid": room.ID, "name": room.Name, "t": room.Type})
+	}
+	return map[string]interface{}{"update": update, "remove": []interface{}{}}, nil
+}
+
+func (s *Server) roomsGet(params []interface{}) (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	rooms := []interface{}{}
+	for _, room := range s.rooms {
+		rooms = append(rooms, map[string]interface{}{"_id": room.ID, "fname": room.Name, "t": room.Type})
+	}
+	return rooms, nil
+}
+
+func (s *Server) sendMessage(params []interface{}) (interface{}, error) {
+	obj := param(params)
+	msg := Message{}
+	msg.RoomID, _ = obj["rid"].(string)
+	msg.ThreadID, _ = obj["tmid"].(string)
+	msg.Text, _ = obj["msg"].(string)
+
+	s.mutex.Lock()
+	if _, ok := s.room(msg.RoomID); !ok {
+		s.mutex.Unlock()
+		return nil, &Error{Code: 403, Type: "error-not-allowed", Reason: "Not allowed"}
+	}
+	msg.UserID, msg.UserName = s.user.ID, s.user.UserName
+	msg = s.store(msg)
+	s.mutex.Unlock()
+
+	s.broadcastMessage(msg)
+	return msg.object(), nil
+}
+
+func (s *Server) updateMessage(params []interface{}) (interface{}, error) {
+	obj := param(params)
+	id, _ := obj["_id"].(string)
+
+	s.mutex.Lock()
+	i, ok := s.message(id)
+	if !ok {
+		s.mutex.Unlock()
+		return nil, &Error{Code: 404, Type: "error-action-not-allowed", Reason: "Message not found"}
+	}
+	s.messages[i].Text, _ = obj["msg"].(string)
+	s.messages[i].Edited = true
+	msg := s.messages[i]
+	s.notify()
+	s.mutex.Unlock()
+
+	s.broadcastMessage(msg)
+	return nil, nil
+}
+
+func (s *Server) deleteMessage(params []interface{}) (interface{}, error) {
+	id, _ := param(params)["_id"].(string)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	i, ok := s.message(id)
+	if !ok {
+		return nil, &Error{Code: 404, Type: "error-action-not-allowed", Reason: "Message not found"}
+	}
+	s.messages = append(s.messages[:i], s.messages[i+1:]...)
+	s.notify()
+	return map[string]interface{}{"_id": id}, nil
+}
+
+// createDirectMessage returns the direct messages room with a user, creating it if necessary.
+func (s *Server) createDirectMessage(params []interface{}) (interface{}, error) {
+	if len(params) == 0 {
+		return nil, &Error{Code: 400, Type: "error-invalid-user", Reason: "Invalid user"}
+	}
+	username, _ := params[0].(string)
+
+	s.mutex.Lock()
+	for _, room := range s.rooms {
+		if room.Type == "d" && room.Name == username {
+			s.mutex.Unlock()
+			return map[string]interface{}{"rid": room.ID, "t": "d"}, nil
+		}
+	}
+	room := Room{ID: s.generateId("d"), Name: username, Type: "d", Members: []string{s.user.UserName, username}}
+	s.mutex.Unlock()
+
+	s.AddRoom(room)
+	return map[string]interface{}{"rid": room.ID, "t": "d"}, nil
+}
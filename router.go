@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+)
+
+// CommandPrefix starts every command, e.g. !help.
+const CommandPrefix = "!"
+
+// Command is something users can ask the bot to do instead of answering, e.g. !reset.
+type Command struct {
+	Name string // Without the prefix.
+	Args string // The arguments in the help, e.g. "<name>".
+	Help string // Used if there is no help_<name> message.
+	Run  func(ctx context.Context, b *Bot, msg rocket.Message, args string) error
+}
+
+// CommandRouter recognizes the commands in messages and runs them.
+type CommandRouter struct {
+	commands map[string]Command
+}
+
+func NewCommandRouter() *CommandRouter {
+	return &CommandRouter{
+		commands: make(map[string]Command),
+	}
+}
+
+func (r *CommandRouter) Register(cmd Command) {
+	r.commands[cmd.Name] = cmd
+}
+
+// Commands returns the registered commands ordered by name.
+func (r *CommandRouter) Commands() []Command {
+	commands := make([]Command, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		commands = append(commands, cmd)
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Name < commands[j].Name
+	})
+	return commands
+}
+
+// Route runs the command in msg. It returns false if msg is not a command, so it should be answered normally.
+func (r *CommandRouter) Route(ctx context.Context, b *Bot, msg rocket.Message) (bool, error) {
+	name, args, ok := parseCommand(msg.GetNotAddressedText())
+	if !ok {
+		return false, nil
+	}
+
+	cmd, ok := r.commands[name]
+	if !ok {
+		return true, reply(msg, b.text(msg, "unknown_command", MessageData{Name: name}))
+	}
+	return true, cmd.Run(ctx, b, msg, args)
+}
+
+// parseCommand splits text into the name of the command and its arguments.
+func parseCommand(text string) (name string, args string, ok bool) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, CommandPrefix) || len(text) == len(CommandPrefix) {
+		return "", "", false
+	}
+	fields := strings.SplitN(text[len(CommandPrefix):], " ", 2)
+	name = strings.ToLower(fields[0])
+	if len(fields) == 2 {
+		args = strings.TrimSpace(fields[1])
+	}
+	return name, args, true
+}
+
+// reply sends text to the author of msg.
+func reply(msg rocket.Message, text string) error {
+	_, err := msg.Reply(fmt.Sprintf("@%s %s", msg.UserName, text))
+	if err != nil {
+		return fmt.Errorf("cannot send reply to rocketchat: %w", err)
+	}
+	return nil
+}
+
+func registerBuiltinCommands(r *CommandRouter) {
+	r.Register(Command{
+		Name: "help",
+		Help: "Lists the commands.",
+		Run:  helpCommand,
+	})
+	r.Register(Command{
+		Name: "reset",
+		Help: "Makes the bot forget the conversation in this room.",
+		Run:  resetCommand,
+	})
+	r.Register(Command{
+		Name: "history",
+		Help: "Shows what the bot remembers from the conversation in this room.",
+		Run:  historyCommand,
+	})
+	r.Register(Command{
+		Name: "model",
+		Args: "[model]",
+		Help: "Shows or changes the model used in this room.",
+		Run:  modelCommand,
+	})
+	r.Register(Command{
+		Name: "persona",
+		Args: "[name|default]",
+		Help: "Lists the personas or changes the persona of the bot in this room.",
+		Run:  personaCommand,
+	})
+	r.Register(Command{
+		Name: "image",
+		Args: "<prompt>",
+		Help: "Draws an image and uploads it to this room.",
+		Run:  imageCommand,
+	})
+	r.Register(Command{
+		Name: "usage",
+		Args: "[user|room|day|model] [days]",
+		Help: "Reports the token usage and its cost of the last 30 (or the given number of) days. Admins only.",
+		Run:  usageCommand,
+	})
+	r.Register(Command{
+		Name: "summarize",
+		Args: "[number of messages|since 2h]",
+		Help: "Summarizes the latest messages of this room.",
+		Run:  recapCommand,
+	})
+}
+
+func helpCommand(ctx context.Context, b *Bot, msg rocket.Message, args string) error {
+	settings := b.Settings(msg)
+	var lines []string
+	for _, cmd := range b.Commands.Commands() {
+		usage := CommandPrefix + cmd.Name
+		if cmd.Args != "" {
+			usage += " " + cmd.Args
+		}
+		help := cmd.Help
+		if b.Messages.Has(settings.Locale, "help_"+cmd.Name) {
+			help = b.text(msg, "help_"+cmd.Name, MessageData{})
+		}
+		lines = append(lines, fmt.Sprintf("`%s` %s", usage, help))
+	}
+	return reply(msg, b.text(msg, "help", MessageData{
+		Model:   settings.Model,
+		Persona: settings.Persona,
+		Text:    strings.Join(lines, "\n"),
+	}))
+}
+
+func resetCommand(ctx context.Context, b *Bot, msg rocket.Message, args string) error {
+	b.History.Clear(conversationPlace(msg))
+	return reply(msg, b.text(msg, "reset", MessageData{}))
+}
+
+func historyCommand(ctx context.Context, b *Bot, msg rocket.Message, args string) error {
+	messages := b.history(msg, b.Settings(msg))
+	if len(messages) == 0 {
+		return reply(msg, b.text(msg, "history_empty", MessageData{}))
+	}
+
+	lines := make([]string, len(messages))
+	for i, m := range messages {
+		content := m.Content
+		if len([]rune(content)) > 100 {
+			content = string([]rune(content)[:100]) + "…"
+		}
+		lines[i] = fmt.Sprintf("*%s*: %s", m.Role, strings.ReplaceAll(content, "\n", " "))
+	}
+	return reply(msg, b.text(msg, "history", MessageData{Count: len(messages), Text: strings.Join(lines, "\n")}))
+}
+
+func modelCommand(ctx context.Context, b *Bot, msg rocket.Message, args string) error {
+	if args == "" {
+		return reply(msg, b.text(msg, "model", MessageData{Model: b.Settings(msg).Model}))
+	}
+
+	if len(b.AllowedModels) > 0 && !contains(b.AllowedModels, args) {
+		return reply(msg, b.text(msg, "model_not_allowed", MessageData{Model: args, List: strings.Join(b.AllowedModels, ", ")}))
+	}
+	b.Rooms.Update(msg.RoomId, func(override *RoomOverride) {
+		override.Model = args
+	})
+	return reply(msg, b.text(msg, "model_changed", MessageData{Model: args}))
+}
+
+func personaCommand(ctx context.Context, b *Bot, msg rocket.Message, args string) error {
+	names := make([]string, 0, len(b.Personas))
+	for name := range b.Personas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if args == "" {
+		if len(names) == 0 {
+			return reply(msg, b.text(msg, "personas_none", MessageData{}))
+		}
+		return reply(msg, b.text(msg, "personas", MessageData{List: strings.Join(names, ", ")}))
+	}
+
+	if args == "default" {
+		args = ""
+	} else {
+		// The names are matched case-insensitively, so "!persona pirate" finds Pirate.
+		found := false
+		for _, name := range names {
+			if strings.EqualFold(name, args) {
+				args, found = name, true
+				break
+			}
+		}
+		if !found {
+			return reply(msg, b.text(msg, "persona_unknown", MessageData{Persona: args, List: strings.Join(names, ", ")}))
+		}
+	}
+	b.Rooms.Update(msg.RoomId, func(override *RoomOverride) {
+		override.Persona = args
+	})
+	if args == "" {
+		return reply(msg, b.text(msg, "persona_default", MessageData{}))
+	}
+	return reply(msg, b.text(msg, "persona_changed", MessageData{Persona: args}))
+}
+
+func imageCommand(ctx context.Context, b *Bot, msg rocket.Message, args string) error {
+	if b.OpenAI.ImageModel == "" {
+		return reply(msg, b.text(msg, "image_disabled", MessageData{}))
+	}
+	if args == "" {
+		return reply(msg, b.text(msg, "image_usage", MessageData{}))
+	}
+
+	// Images are the most expensive requests, so they are limited like the questions.
+	err := b.Limits.Check(msg.UserId, msg.RoomId)
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return reply(msg, b.limitText(msg, limitErr))
+	} else if err != nil {
+		return fmt.Errorf("cannot check the limits: %w", err)
+	}
+
+	if b.Settings(msg).InputModeration {
+		flagged, err := b.moderateInput(ctx, msg, args)
+		if err != nil || flagged {
+			return err
+		}
+	}
+
+	msg.SetIsTyping(true)
+	defer msg.SetIsTyping(false)
+
+	iReq := &openai.ImageRequest{
+		Model:          b.OpenAI.ImageModel,
+		Prompt:         args,
+		N:              1,
+		Size:           b.OpenAI.ImageSize,
+		ResponseFormat: "b64_json",
+	}
+	if b.OpenAI.SendUserId {
+		iReq.User = &msg.UserId
+	}
+	iResp, err := b.OpenAI.Image(ctx, iReq)
+	if err != nil {
+		return fmt.Errorf("cannot generate image: %w", err)
+	}
+	b.record(msg, len(iResp.Data)*b.Limits.ImageTokens, UsageRecord{Model: b.OpenAI.ImageModel, Images: len(iResp.Data)})
+	data, err := iResp.Data[0].Bytes()
+	if err != nil {
+		return fmt.Errorf("cannot decode image: %w", err)
+	}
+
+	text := fmt.Sprintf("@%s %s", msg.UserName, args)
+	if revised := iResp.Data[0].RevisedPrompt; revised != "" {
+		text = fmt.Sprintf("@%s %s", msg.UserName, revised)
+	}
+	err = msg.ReplyWithFile("image.png", data, text)
+	if err != nil {
+		return fmt.Errorf("cannot upload image to rocketchat: %w", err)
+	}
+	return nil
+}
+
+func usageCommand(ctx context.Context, b *Bot, msg rocket.Message, args string) error {
+	if !b.IsAdmin(msg) {
+		return reply(msg, b.text(msg, "usage_admins_only", MessageData{}))
+	}
+	if b.Usage == nil {
+		return reply(msg, b.text(msg, "usage_not_recorded", MessageData{}))
+	}
+
+	by, days := "user", 30
+	for _, arg := range strings.Fields(args) {
+		if n, err := strconv.Atoi(arg); err == nil && n > 0 {
+			days = n
+		} else {
+			by = arg
+		}
+	}
+
+	to := time.Now()
+	records, err := b.Usage.List(to.AddDate(0, 0, -days), to)
+	if err != nil {
+		return err
+	}
+	report, err := UsageReport(records, by, b.Pricing)
+	if errors.Is(err, ErrUnknownGrouping) {
+		return reply(msg, b.text(msg, "usage_unknown_grouping", MessageData{Name: by, List: strings.Join(UsageGroupings, ", ")}))
+	} else if err != nil {
+		return err
+	}
+	return reply(msg, b.text(msg, "usage_report", MessageData{Days: days, Text: FormatUsageReport(report, by)}))
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
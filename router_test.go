@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/mimrock/rocketchat_openai_bot/openai/openaitest"
+	"github.com/mimrock/rocketchat_openai_bot/rocket/rockettest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		text, name, args string
+		ok               bool
+	}{
+		{"!reset", "reset", "", true},
+		{"  !model gpt-4 ", "model", "gpt-4", true},
+		{"!Persona  Pirate captain", "persona", "Pirate captain", true},
+		{"!", "", "", false},
+		{"hello !reset", "", "", false},
+		{"what is 2+2?", "", "", false},
+	}
+	for _, test := range tests {
+		name, args, ok := parseCommand(test.text)
+		assert.Equal(t, test.ok, ok, test.text)
+		assert.Equal(t, test.name, name, test.text)
+		assert.Equal(t, test.args, args, test.text)
+	}
+}
+
+func TestImageCommand(t *testing.T) {
+	c := newConversation(t, func(cfg *config.Config) {
+		cfg.OpenAI.ImageModel = "dall-e-3"
+		cfg.Limits.MonthlyTokens = 8000
+		cfg.Limits.ImageTokens = 8000
+	})
+	c.bot.Usage = NewMemoryUsageStore()
+	draw := func() {
+		c.rocket.Post(rockettest.Message{RoomID: "d1", UserID: "alice-id", UserName: "alice", Text: "!image A cat named Tom"})
+		msg, err := c.bot.Rocket.GetNewMessage()
+		require.NoError(t, err)
+		require.NoError(t, c.bot.Handle(context.Background(), msg))
+	}
+
+	draw()
+	uploads := c.rocket.Uploads()
+	require.Len(t, uploads, 1)
+	assert.Equal(t, openaitest.ImageData, uploads[0].Data)
+	assert.Equal(t, "@alice A cat named Tom", uploads[0].Text)
+
+	records, err := c.bot.Usage.List(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "dall-e-3", records[0].Model)
+	assert.Equal(t, 1, records[0].Images)
+
+	// The image used up the monthly quota, so the next one is not drawn.
+	draw()
+	assert.Len(t, c.openai.Requests(openaitest.ImagePath), 1)
+	assert.Len(t, c.rocket.Uploads(), 1)
+	require.Len(t, c.answers(), 1)
+	assert.Contains(t, c.answers()[0], "monthly budget")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultSummaryPrompt asks the model to condense the older turns of a conversation.
+const DefaultSummaryPrompt = "Summarize the conversation below in a few sentences. Keep the facts, names, decisions " +
+	"and open questions that are needed to continue it. Write in the language of the conversation."
+
+// summaryPrefix starts the content of the summaries, so the model knows what they are.
+const summaryPrefix = "Summary of the earlier conversation: "
+
+// isSummary tells whether m is the summary of the older turns at the front of a history. The history has no other
+// system messages.
+func isSummary(m openai.Message) bool {
+	return m.Role == "system"
+}
+
+// summarizeHistory condenses the older turns of the conversation of rocketmsg into a summary, once its history
+// reaches SummarizeThreshold messages (or the history size of the room, if the threshold is 0). The last
+// SummarizeKeep messages are kept as they are.
+func (b *Bot) summarizeHistory(ctx context.Context, rocketmsg rocket.Message, settings RoomSettings) error {
+	threshold := b.SummarizeThreshold
+	if threshold == 0 {
+		threshold = settings.HistorySize
+	}
+	place := conversationPlace(rocketmsg)
+	history := b.History.AsOpenAIMessages(place)
+	if len(history) < threshold {
+		return nil
+	}
+
+	// Summarize whole turns, so the kept part starts with a question.
+	n := len(history) - b.SummarizeKeep
+	for n > 0 && n < len(history) && history[n].Role != "user" {
+		n--
+	}
+	if n <= 0 || (n == 1 && isSummary(history[0])) {
+		return nil
+	}
+
+	var transcript strings.Builder
+	for _, m := range history[:n] {
+		if isSummary(m) {
+			fmt.Fprintf(&transcript, "%s\n\n", m.Content)
+			continue
+		}
+		fmt.Fprintf(&transcript, "%s: %s\n\n", m.Role, m.Content)
+	}
+
+	model := b.SummarizeModel
+	if model == "" {
+		model = settings.Model
+	}
+	cReq := &openai.CompletionRequest{
+		Model: model,
+		Messages: []openai.Message{
+			{Role: "system", Content: b.SummaryPrompt},
+			{Role: "user", Content: transcript.String()},
+		},
+	}
+	cresp, err := b.Chat.Completion(ctx, cReq)
+	if err != nil {
+		return fmt.Errorf("cannot perform summarization request: %w", err)
+	}
+	if len(cresp.Choices) == 0 {
+		return fmt.Errorf("no choices returned")
+	}
+	b.recordUsage(rocketmsg, cReq, cresp)
+
+	summary := strings.TrimSpace(cresp.Choices[0].Message.Content)
+	summary = strings.TrimPrefix(summary, summaryPrefix)
+	b.History.ReplaceWithSummary(place, n, openai.Message{
+		Role:    "system",
+		Content: summaryPrefix + summary,
+	})
+	log.WithField("place", place).WithField("messages", n).WithField("summary", summary).Debug("Older turns summarized.")
+	return nil
+}
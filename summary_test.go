@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummarizeHistory(t *testing.T) {
+	// The fake server answers with the last message of the request, so the summaries are the transcripts of the
+	// summarized turns, and every question they cover can be found in them.
+	c := newConversation(t, func(cfg *config.Config) {
+		cfg.OpenAI.Summarize = true
+		cfg.OpenAI.SummarizeKeep = 4
+	})
+
+	for turn := 1; turn <= 8; turn++ {
+		require.NoError(t, c.ask(t, fmt.Sprintf("question %d", turn)))
+
+		history := c.bot.History.AsOpenAIMessages("alice")
+		assert.LessOrEqual(t, len(history), 6, "turn %d", turn)
+		for i := 1; i < len(history); i++ {
+			assert.False(t, isSummary(history[i]), "turn %d: the summary is at the front", turn)
+		}
+		for question := 1; question <= turn; question++ {
+			text := fmt.Sprintf("question %d", question)
+			covered := false
+			for _, m := range history {
+				if m.Content == text || isSummary(m) && strings.Contains(m.Content, "user: "+text+"\n") {
+					covered = true
+				}
+			}
+			assert.True(t, covered, "turn %d: %s is neither summarized nor kept", turn, text)
+		}
+	}
+
+	// Each summary includes the previous one.
+	summaries := 0
+	for _, cReq := range c.openai.CompletionRequests() {
+		if cReq.Messages[0].Content == DefaultSummaryPrompt {
+			if summaries > 0 {
+				assert.Contains(t, cReq.Messages[1].Content, summaryPrefix)
+			}
+			summaries++
+		}
+	}
+	assert.Greater(t, summaries, 1)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ToolFunc runs a tool for the model. msg is the message the bot is answering, args is the JSON object of the
+// arguments generated by the model. The result is sent back to the model.
+type ToolFunc func(ctx context.Context, b *Bot, msg rocket.Message, args json.RawMessage) (string, error)
+
+// Tool is a Go function the model can call.
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  string // JSON schema of the arguments.
+	Run         ToolFunc
+}
+
+// ToolRegistry keeps the tools the model can call.
+type ToolRegistry struct {
+	tools map[string]Tool
+}
+
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{
+		tools: make(map[string]Tool),
+	}
+}
+
+func (r *ToolRegistry) Register(tool Tool) {
+	r.tools[tool.Name] = tool
+}
+
+// Definitions returns the tools with the given names in the format of the completion request, ordered by name.
+// Unknown names are skipped.
+func (r *ToolRegistry) Definitions(names []string) []openai.Tool {
+	var definitions []openai.Tool
+	for _, name := range names {
+		tool, ok := r.tools[name]
+		if !ok {
+			log.WithField("tool", name).Warn("Unknown tool.")
+			continue
+		}
+		definitions = append(definitions, openai.Tool{
+			Type: "function",
+			Function: openai.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  json.RawMessage(tool.Parameters),
+			},
+		})
+	}
+	sort.Slice(definitions, func(i, j int) bool {
+		return definitions[i].Function.Name < definitions[j].Function.Name
+	})
+	return definitions
+}
+
+// Call runs the tool the model asked for and returns the message with the result. Errors are reported to the model
+// in the result, so it can explain or work around them.
+func (r *ToolRegistry) Call(ctx context.Context, b *Bot, msg rocket.Message, call openai.ToolCall) openai.Message {
+	result := openai.Message{
+		Role:       "tool",
+		ToolCallID: call.ID,
+	}
+
+	tool, ok := r.tools[call.Function.Name]
+	if !ok {
+		result.Content = fmt.Sprintf("error: unknown tool %s", call.Function.Name)
+		return result
+	}
+
+	args := json.RawMessage(call.Function.Arguments)
+	if len(strings.TrimSpace(call.Function.Arguments)) == 0 {
+		args = json.RawMessage("{}")
+	}
+	if !json.Valid(args) {
+		result.Content = "error: the arguments are not valid JSON"
+		return result
+	}
+
+	log.WithField("tool", tool.Name).WithField("arguments", call.Function.Arguments).Debug("Calling tool.")
+	content, err := tool.Run(ctx, b, msg, args)
+	if err != nil {
+		log.WithError(err).WithField("tool", tool.Name).Warn("Tool failed.")
+		result.Content = fmt.Sprintf("error: %s", err.Error())
+		return result
+	}
+	result.Content = content
+	return result
+}
+
+func registerBuiltinTools(r *ToolRegistry) {
+	r.Register(Tool{
+		Name:        "list_room_members",
+		Description: "Lists the usernames of the members of the Rocket.Chat room the conversation is in.",
+		Parameters:  `{"type": "object", "properties": {}}`,
+		Run:         listRoomMembersTool,
+	})
+	r.Register(Tool{
+		Name:        "get_message",
+		Description: "Fetches a Rocket.Chat message by its id, e.g. the value of the msg parameter of a quoted message link.",
+		Parameters:  `{"type": "object", "properties": {"message_id": {"type": "string", "description": "The id of the message."}}, "required": ["message_id"]}`,
+		Run:         getMessageTool,
+	})
+}
+
+func listRoomMembersTool(ctx context.Context, b *Bot, msg rocket.Message, args json.RawMessage) (string, error) {
+	users, err := b.Rocket.ListUsersInRoomId(msg.RoomId)
+	if err != nil {
+		return "", fmt.Errorf("cannot list the members of the room: %w", err)
+	}
+	return strings.Join(users, ", "), nil
+}
+
+func getMessageTool(ctx context.Context, b *Bot, msg rocket.Message, args json.RawMessage) (string, error) {
+	var params struct {
+		MessageId string `json:"message_id"`
+	}
+	err := json.Unmarshal(args, &params)
+	if err != nil || params.MessageId == "" {
+		return "", fmt.Errorf("message_id is required")
+	}
+
+	message, err := b.Rocket.RequestMessage(params.MessageId)
+	if errors.Is(err, rocket.ErrMessageNotFound) {
+		return "", err
+	} else if err != nil {
+		return "", fmt.Errorf("cannot fetch the message: %w", err)
+	}
+	// The bot is in rooms the user may not be in, so only the messages of this room are shown. Nothing is told about
+	// the others, not even that they exist.
+	if message.RoomId != msg.RoomId {
+		return "", rocket.ErrMessageNotFound
+	}
+	return fmt.Sprintf("%s (%s) wrote at %s: %s", message.UserName, message.RoomName, message.Timestamp.Format("2006-01-02 15:04"), message.Text), nil
+}
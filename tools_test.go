@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/mimrock/rocketchat_openai_bot/openai"
+	"github.com/mimrock/rocketchat_openai_bot/rocket"
+	"github.com/mimrock/rocketchat_openai_bot/rocket/rockettest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToolRegistry(t *testing.T) {
+	r := NewToolRegistry()
+	r.Register(Tool{
+		Name:        "echo",
+		Description: "Echoes the text.",
+		Parameters:  `{"type": "object", "properties": {"text": {"type": "string"}}}`,
+		Run: func(ctx context.Context, b *Bot, msg rocket.Message, args json.RawMessage) (string, error) {
+			var params struct{ Text string }
+			err := json.Unmarshal(args, &params)
+			return params.Text, err
+		},
+	})
+	r.Register(Tool{
+		Name: "broken",
+		Run: func(ctx context.Context, b *Bot, msg rocket.Message, args json.RawMessage) (string, error) {
+			return "", errors.New("out of order")
+		},
+	})
+
+	definitions := r.Definitions([]string{"echo", "missing", "broken"})
+	assert.Equal(t, 2, len(definitions))
+	assert.Equal(t, "broken", definitions[0].Function.Name)
+	assert.Equal(t, "echo", definitions[1].Function.Name)
+	assert.Equal(t, "function", definitions[1].Type)
+
+	call := func(name string, args string) openai.Message {
+		return r.Call(context.Background(), nil, rocket.Message{}, openai.ToolCall{
+			ID:       "call_1",
+			Function: openai.FunctionCall{Name: name, Arguments: args},
+		})
+	}
+	assert.Equal(t, openai.Message{Role: "tool", ToolCallID: "call_1", Content: "hi"}, call("echo", `{"text": "hi"}`))
+	assert.Equal(t, "error: out of order", call("broken", "").Content)
+	assert.Equal(t, "error: unknown tool missing", call("missing", "{}").Content)
+	assert.Equal(t, "error: the arguments are not valid JSON", call("echo", `{"text": `).Content)
+}
+
+func TestGetMessageTool(t *testing.T) {
+	server := rockettest.NewServer(
+		rockettest.User{ID: "bot-id", UserName: "bartender", Password: "secret"},
+		rockettest.Room{ID: "r1", Name: "general", Type: "c"},
+		rockettest.Room{ID: "p1", Name: "management", Type: "p"},
+	)
+	defer server.Close()
+
+	cfg := server.Config()
+	rock, err := rocket.NewConnectionFromConfig(cfg)
+	require.NoError(t, err)
+	defer rock.Close()
+	require.NoError(t, server.WaitSubscribed("p1"))
+	b := NewBotFromConfig(cfg, rock, nil, openai.NewFromConfig(cfg), NewHistory())
+
+	public := server.Post(rockettest.Message{RoomID: "r1", UserID: "u1", UserName: "alice", Text: "Happy hour at 5."})
+	secret := server.Post(rockettest.Message{RoomID: "p1", UserID: "u2", UserName: "bob", Text: "The bar is closing."})
+	msg := rocket.Message{RoomId: "r1", RoomName: "general", UserName: "alice"}
+
+	text, err := getMessageTool(context.Background(), b, msg, json.RawMessage(`{"message_id": "`+public.ID+`"}`))
+	require.NoError(t, err)
+	assert.Contains(t, text, "alice (general) wrote at")
+	assert.Contains(t, text, "Happy hour at 5.")
+
+	// The messages of the other rooms of the bot are not shown.
+	_, err = getMessageTool(context.Background(), b, msg, json.RawMessage(`{"message_id": "`+secret.ID+`"}`))
+	assert.EqualError(t, err, "message not found")
+	_, err = getMessageTool(context.Background(), b, msg, json.RawMessage(`{"message_id": "missing"}`))
+	assert.EqualError(t, err, "message not found")
+}
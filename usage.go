@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	bolt "go.etcd.io/bbolt"
+)
+
+// UsageRecord is the usage of a completion, a transcription or an image generation.
+type UsageRecord struct {
+	Time             time.Time
+	UserId           string
+	UserName         string
+	RoomId           string
+	RoomName         string
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	Images           int
+	Estimated        bool // The tokens are counted by the bot, because the provider did not report them.
+}
+
+// UsageStore keeps the usage records.
+type UsageStore interface {
+	Add(record UsageRecord) error
+	// List returns the records between from (inclusive) and to (exclusive), oldest first.
+	List(from time.Time, to time.Time) ([]UsageRecord, error)
+}
+
+// MemoryUsageStore keeps the usage records in memory. They are lost when the bot stops.
+type MemoryUsageStore struct {
+	records []UsageRecord
+	mutex   sync.RWMutex
+}
+
+func NewMemoryUsageStore() *MemoryUsageStore {
+	return &MemoryUsageStore{}
+}
+
+func (s *MemoryUsageStore) Add(record UsageRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *MemoryUsageStore) List(from time.Time, to time.Time) ([]UsageRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var records []UsageRecord
+	for _, record := range s.records {
+		if !record.Time.Before(from) && record.Time.Before(to) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+var usageBucket = []byte("usage")
+
+// usageKeyFormat makes the keys of the records sort by time.
+const usageKeyFormat = "2006-01-02T15:04:05.000000000Z"
+
+// BoltUsageStore keeps the usage records in a bolt database file.
+type BoltUsageStore struct {
+	db *bolt.DB
+}
+
+func NewBoltUsageStore(db *bolt.DB) (*BoltUsageStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(usageBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create usage bucket: %w", err)
+	}
+	return &BoltUsageStore{db: db}, nil
+}
+
+func (s *BoltUsageStore) Add(record UsageRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("cannot marshal usage record: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usageBucket)
+		// The sequence keeps the records of the same moment apart.
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s/%d", record.Time.UTC().Format(usageKeyFormat), seq)
+		return bucket.Put([]byte(key), data)
+	})
+}
+
+func (s *BoltUsageStore) List(from time.Time, to time.Time) ([]UsageRecord, error) {
+	var records []UsageRecord
+	start := []byte(from.UTC().Format(usageKeyFormat))
+	end := []byte(to.UTC().Format(usageKeyFormat))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(usageBucket).Cursor()
+		for k, v := c.Seek(start); k != nil && string(k) < string(end); k, v = c.Next() {
+			var record UsageRecord
+			err := json.Unmarshal(v, &record)
+			if err != nil {
+				return fmt.Errorf("invalid usage record %s: %w", k, err)
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list usage records: %w", err)
+	}
+	return records, nil
+}
+
+// UsageRow is the usage of a user, a room, a day or a model in a report.
+type UsageRow struct {
+	Key              string
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	Images           int
+	Cost             float64
+	Estimated        int // The requests with estimated tokens.
+}
+
+// ErrUnknownGrouping is returned by UsageReport for a grouping that is not in UsageGroupings.
+var ErrUnknownGrouping = errors.New("unknown grouping")
+
+// UsageGroupings are the ways a usage report can be grouped.
+var UsageGroupings = []string{"user", "room", "day", "model"}
+
+// UsageReport sums the records grouped by user, room, day or model. The rows are ordered by cost, except for days,
+// which are in chronological order.
+func UsageReport(records []UsageRecord, by string, pricing map[string]config.Price) ([]UsageRow, error) {
+	if !contains(UsageGroupings, by) {
+		// Checked before the loop, so it is reported even if there are no records.
+		return nil, fmt.Errorf("%w: %s, use one of %s", ErrUnknownGrouping, by, strings.Join(UsageGroupings, ", "))
+	}
+	rows := make(map[string]*UsageRow)
+	for _, record := range records {
+		var key string
+		switch by {
+		case "user":
+			key = record.UserName
+		case "room":
+			key = record.RoomName
+		case "day":
+			key = record.Time.UTC().Format("2006-01-02")
+		case "model":
+			key = record.Model
+		}
+
+		row, ok := rows[key]
+		if !ok {
+			row = &UsageRow{Key: key}
+			rows[key] = row
+		}
+		row.Requests++
+		row.PromptTokens += record.PromptTokens
+		row.CompletionTokens += record.CompletionTokens
+		row.Images += record.Images
+		if record.Estimated {
+			row.Estimated++
+		}
+		row.Cost += cost(record, pricing)
+	}
+
+	report := make([]UsageRow, 0, len(rows))
+	for _, row := range rows {
+		report = append(report, *row)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if by == "day" || report[i].Cost == report[j].Cost {
+			return report[i].Key < report[j].Key
+		}
+		return report[i].Cost > report[j].Cost
+	})
+	return report, nil
+}
+
+// cost returns the price of record, using the price of the longest model prefix in pricing.
+func cost(record UsageRecord, pricing map[string]config.Price) float64 {
+	var price config.Price
+	matched := ""
+	for prefix, p := range pricing {
+		if strings.HasPrefix(record.Model, prefix) && len(prefix) > len(matched) {
+			price, matched = p, prefix
+		}
+	}
+	return (float64(record.PromptTokens)*price.Prompt+float64(record.CompletionTokens)*price.Completion)/1e6 +
+		float64(record.Images)*price.Image
+}
+
+// FormatUsageReport formats report as a table.
+func FormatUsageReport(report []UsageRow, by string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-24s %8s %12s %12s %8s %10s\n", by, "requests", "prompt", "completion", "images", "cost")
+	var total UsageRow
+	for _, row := range report {
+		fmt.Fprintf(&b, "%-24s %8d %12d %12d %8d %10.4f\n", row.Key, row.Requests, row.PromptTokens, row.CompletionTokens, row.Images, row.Cost)
+		total.Requests += row.Requests
+		total.PromptTokens += row.PromptTokens
+		total.CompletionTokens += row.CompletionTokens
+		total.Images += row.Images
+		total.Cost += row.Cost
+		total.Estimated += row.Estimated
+	}
+	fmt.Fprintf(&b, "%-24s %8d %12d %12d %8d %10.4f\n", "total", total.Requests, total.PromptTokens, total.CompletionTokens, total.Images, total.Cost)
+	if total.Estimated > 0 {
+		fmt.Fprintf(&b, "The tokens of %d requests are estimated, the provider did not report them.\n", total.Estimated)
+	}
+	return b.String()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mimrock/rocketchat_openai_bot/config"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestUsageReport(t *testing.T) {
+	day := time.Date(2023, 5, 31, 12, 0, 0, 0, time.UTC)
+	records := []UsageRecord{
+		{Time: day, UserName: "alice", Model: "gpt-4o-mini", PromptTokens: 1000000, CompletionTokens: 0},
+		{Time: day, UserName: "bob", Model: "gpt-4o", PromptTokens: 1000000, CompletionTokens: 1000000},
+		{Time: day.Add(time.Hour), UserName: "alice", Model: "gpt-4o", PromptTokens: 0, CompletionTokens: 1000000},
+	}
+	pricing := map[string]config.Price{
+		"gpt-4o":      {Prompt: 5, Completion: 15},
+		"gpt-4o-mini": {Prompt: 0.15, Completion: 0.6},
+	}
+
+	report, err := UsageReport(records, "user", pricing)
+	assert.NoError(t, err)
+	assert.Equal(t, []UsageRow{
+		{Key: "bob", Requests: 1, PromptTokens: 1000000, CompletionTokens: 1000000, Cost: 20},
+		{Key: "alice", Requests: 2, PromptTokens: 1000000, CompletionTokens: 1000000, Cost: 15.15},
+	}, report)
+
+	_, err = UsageReport(records, "planet", pricing)
+	assert.Error(t, err)
+
+	records[0].Estimated = true
+	report, err = UsageReport(records, "model", pricing)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report[1].Estimated)
+	assert.Contains(t, FormatUsageReport(report, "model"), "The tokens of 1 requests are estimated")
+}
+
+func TestBoltUsageStore(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	store, err := NewBoltUsageStore(db)
+	assert.NoError(t, err)
+
+	day := time.Date(2023, 5, 31, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, store.Add(UsageRecord{Time: day.AddDate(0, 0, -1), UserName: "alice"}))
+	assert.NoError(t, store.Add(UsageRecord{Time: day, UserName: "bob"}))
+	assert.NoError(t, store.Add(UsageRecord{Time: day, UserName: "carol"}))
+
+	records, err := store.List(day, day.Add(time.Hour))
+	assert.NoError(t, err)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "bob", records[0].UserName)
+		assert.Equal(t, "carol", records[1].UserName)
+	}
+}